@@ -0,0 +1,160 @@
+package h2conn
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Authenticator authenticates requests before they are accepted by the Server.
+type Authenticator interface {
+	// Authenticate returns the authenticated principal of the request, which is available
+	// with Conn.Principal. If the request is rejected, it returns an error. An *AuthError can
+	// be returned to control the status code and header of the rejection response.
+	Authenticate(r *http.Request) (principal interface{}, err error)
+}
+
+// AuthenticatorFunc is an adapter to use an ordinary function as an Authenticator.
+type AuthenticatorFunc func(r *http.Request) (interface{}, error)
+
+// Authenticate calls f(r).
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (interface{}, error) {
+	return f(r)
+}
+
+// ErrUnauthenticated is returned by the shipped authenticators if the request has no
+// credentials, or the credentials are invalid.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// AuthError is an authentication error that controls the rejection response.
+// It is returned by Accept when the request was rejected by the Authenticator, in which case
+// the rejection response was already written and the handler should not write to it.
+type AuthError struct {
+	// StatusCode is the status code of the rejection response.
+	// The default, if not set, is http.StatusUnauthorized.
+	StatusCode int
+	// Header is added to the rejection response, for example the WWW-Authenticate header.
+	Header http.Header
+	// Err is the reason for the rejection.
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authentication failed: %s", e.Err)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// authenticate authenticates the request. If it is rejected, it writes the rejection response
+// and returns an *AuthError.
+func authenticate(a Authenticator, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	principal, err := a.Authenticate(r)
+	if err == nil {
+		return principal, nil
+	}
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		authErr = &AuthError{Err: err}
+	}
+	status := authErr.StatusCode
+	if status == 0 {
+		status = http.StatusUnauthorized
+	}
+	for k, v := range authErr.Header {
+		w.Header()[k] = v
+	}
+	http.Error(w, http.StatusText(status), status)
+	return nil, authErr
+}
+
+// BearerAuth authenticates requests with a bearer token in the Authorization header.
+// The principal is the one returned by Validate.
+type BearerAuth struct {
+	// Realm is sent in the WWW-Authenticate header of rejection responses.
+	Realm string
+	// Validate returns the principal of a valid token, or an error if the token is invalid.
+	Validate func(token string) (interface{}, error)
+}
+
+// Authenticate implements the Authenticator interface.
+func (a *BearerAuth) Authenticate(r *http.Request) (interface{}, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, a.reject(ErrUnauthenticated)
+	}
+	principal, err := a.Validate(token)
+	if err != nil {
+		return nil, a.reject(err)
+	}
+	return principal, nil
+}
+
+func (a *BearerAuth) reject(err error) error {
+	return &AuthError{
+		Header: http.Header{"Www-Authenticate": []string{fmt.Sprintf("Bearer realm=%q", a.Realm)}},
+		Err:    err,
+	}
+}
+
+// BasicAuth authenticates requests with HTTP basic authentication.
+// The principal is the username.
+type BasicAuth struct {
+	// Realm is sent in the WWW-Authenticate header of rejection responses.
+	Realm string
+	// Validate returns true if the username and password are valid.
+	// If not set, the credentials are checked against Users.
+	Validate func(username, password string) bool
+	// Users maps usernames to passwords, it is used if Validate is not set.
+	Users map[string]string
+}
+
+// Authenticate implements the Authenticator interface.
+func (a *BasicAuth) Authenticate(r *http.Request) (interface{}, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok || !a.valid(username, password) {
+		return nil, &AuthError{
+			Header: http.Header{"Www-Authenticate": []string{fmt.Sprintf("Basic realm=%q", a.Realm)}},
+			Err:    ErrUnauthenticated,
+		}
+	}
+	return username, nil
+}
+
+func (a *BasicAuth) valid(username, password string) bool {
+	if a.Validate != nil {
+		return a.Validate(username, password)
+	}
+	want, ok := a.Users[username]
+	return ok && subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+}
+
+// ClientCertAuth authenticates requests by the subject of the TLS client certificate.
+// The server TLS configuration should request and verify client certificates, for example with
+// tls.VerifyClientCertIfGiven and ClientCAs, certificates that were not verified are rejected.
+// The principal is the common name of the certificate subject.
+type ClientCertAuth struct {
+	// CommonNames are the allowed common names of the certificate subject.
+	// If empty, every verified certificate is allowed.
+	CommonNames []string
+}
+
+// Authenticate implements the Authenticator interface.
+func (a *ClientCertAuth) Authenticate(r *http.Request) (interface{}, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, &AuthError{Err: ErrUnauthenticated}
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if len(a.CommonNames) == 0 {
+		return name, nil
+	}
+	for _, allowed := range a.CommonNames {
+		if name == allowed {
+			return name, nil
+		}
+	}
+	return nil, &AuthError{StatusCode: http.StatusForbidden, Err: fmt.Errorf("subject %q is not allowed", name)}
+}
@@ -0,0 +1,183 @@
+package h2conn
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/posener/h2conn/h2test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestAuthenticator(t *testing.T) {
+	t.Parallel()
+
+	bearer := &BearerAuth{
+		Realm: "test",
+		Validate: func(token string) (interface{}, error) {
+			if token != "secret" {
+				return nil, errors.New("invalid token")
+			}
+			return "alice", nil
+		},
+	}
+	basic := &BasicAuth{Realm: "test", Users: map[string]string{"bob": "pass"}}
+
+	tests := []struct {
+		name          string
+		auth          Authenticator
+		header        http.Header
+		wantStatus    int
+		wantAuth      string
+		wantPrincipal interface{}
+	}{
+		{
+			name:          "bearer",
+			auth:          bearer,
+			header:        http.Header{"Authorization": []string{"Bearer secret"}},
+			wantStatus:    http.StatusOK,
+			wantPrincipal: "alice",
+		},
+		{
+			name:       "bearer invalid token",
+			auth:       bearer,
+			header:     http.Header{"Authorization": []string{"Bearer guess"}},
+			wantStatus: http.StatusUnauthorized,
+			wantAuth:   `Bearer realm="test"`,
+		},
+		{
+			name:       "bearer missing token",
+			auth:       bearer,
+			wantStatus: http.StatusUnauthorized,
+			wantAuth:   `Bearer realm="test"`,
+		},
+		{
+			name:          "basic",
+			auth:          basic,
+			header:        http.Header{"Authorization": []string{"Basic Ym9iOnBhc3M="}}, // bob:pass
+			wantStatus:    http.StatusOK,
+			wantPrincipal: "bob",
+		},
+		{
+			name:       "basic invalid password",
+			auth:       basic,
+			header:     http.Header{"Authorization": []string{"Basic Ym9iOmd1ZXNz"}}, // bob:guess
+			wantStatus: http.StatusUnauthorized,
+			wantAuth:   `Basic realm="test"`,
+		},
+		{
+			name: "func",
+			auth: AuthenticatorFunc(func(r *http.Request) (interface{}, error) {
+				return nil, &AuthError{StatusCode: http.StatusForbidden, Err: errors.New("banned")}
+			}),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "client certificate missing",
+			auth:       &ClientCertAuth{},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			u := Server{Authenticator: tt.auth}
+			server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := u.Accept(w, r)
+				if tt.wantStatus != http.StatusOK {
+					var authErr *AuthError
+					assert.True(t, errors.As(err, &authErr), "got error: %v", err)
+					return
+				}
+				require.NoError(t, err)
+				assert.Equal(t, tt.wantPrincipal, conn.Principal())
+			}))
+			defer server.Close()
+
+			cl := insecureClient
+			cl.Header = tt.header
+			conn, resp, err := cl.Connect(context.Background(), server.URL)
+			require.NoError(t, err)
+			defer conn.Close()
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			assert.Equal(t, tt.wantAuth, resp.Header.Get("WWW-Authenticate"))
+		})
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	t.Parallel()
+
+	alice, bob := clientCert(t, "alice"), clientCert(t, "bob")
+	pool := x509.NewCertPool()
+	pool.AddCert(alice.Leaf)
+	pool.AddCert(bob.Leaf)
+
+	u := Server{Authenticator: &ClientCertAuth{CommonNames: []string{"alice"}}}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := u.Accept(w, r)
+		if err != nil {
+			return
+		}
+		assert.Equal(t, "alice", conn.Principal())
+	}))
+	require.NoError(t, http2.ConfigureServer(server.Config, nil))
+	server.TLS = server.Config.TLSConfig
+	server.TLS.ClientAuth = tls.VerifyClientCertIfGiven
+	server.TLS.ClientCAs = pool
+	server.StartTLS()
+	defer server.Close()
+
+	for _, tt := range []struct {
+		cert       tls.Certificate
+		wantStatus int
+	}{
+		{cert: alice, wantStatus: http.StatusOK},
+		{cert: bob, wantStatus: http.StatusForbidden},
+	} {
+		cl := Client{Client: &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{tt.cert},
+		}}}}
+		conn, resp, err := cl.Connect(context.Background(), server.URL)
+		require.NoError(t, err)
+		conn.Close()
+		assert.Equal(t, tt.wantStatus, resp.StatusCode)
+	}
+}
+
+// clientCert returns a self signed client certificate with the given common name.
+func clientCert(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
@@ -0,0 +1,160 @@
+package h2conn
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/posener/h2conn/framing"
+)
+
+// Chan message types. Each message is a framing message that starts with its type, such that
+// the end of the messages can be sent in-band.
+const (
+	chanData byte = iota
+	chanEnd
+)
+
+// Chan communicates with the other side of a connection using Go channels.
+// Each message that is sent on the Send channel is received as a single message on the Recv
+// channel of the other side, which should also use a Chan.
+//
+// Closing the Send channel tells the other side that this side is done sending, and closes the
+// write side of the connection on the client side. The Recv channel is closed when the other
+// side is done sending. When both directions are done, or on the first error, the connection
+// is closed and the Done channel is closed.
+type Chan struct {
+	conn   *Conn
+	framer *framing.Framer
+	send   chan []byte
+	recv   chan []byte
+	done   chan struct{}
+
+	errOnce sync.Once
+	err     error
+}
+
+// NewChan starts a channel based communication on a connection.
+// The connection should not be used directly after this call.
+func NewChan(conn *Conn) *Chan {
+	ch := &Chan{
+		conn:   conn,
+		framer: framing.NewFramer(conn),
+		send:   make(chan []byte),
+		recv:   make(chan []byte),
+		done:   make(chan struct{}),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ch.sendLoop()
+	}()
+	go func() {
+		defer wg.Done()
+		ch.recvLoop()
+	}()
+	go func() {
+		wg.Wait()
+		conn.Close()
+		close(ch.done)
+	}()
+
+	return ch
+}
+
+// Send returns the channel of outgoing messages.
+// Sending on the channel blocks until the message was written to the connection, so a
+// sender should also select on the Done channel.
+func (ch *Chan) Send() chan<- []byte {
+	return ch.send
+}
+
+// Recv returns the channel of incoming messages.
+func (ch *Chan) Recv() <-chan []byte {
+	return ch.recv
+}
+
+// Done returns a channel that is closed when the communication is over.
+func (ch *Chan) Done() <-chan struct{} {
+	return ch.done
+}
+
+// Err returns the error that ended the communication.
+// It returns nil if the communication ended gracefully or was closed with Close.
+// It should be called after the Done channel is closed.
+func (ch *Chan) Err() error {
+	<-ch.done
+	return ch.err
+}
+
+// Close closes the underlying connection and terminates the communication.
+func (ch *Chan) Close() error {
+	return ch.conn.Close()
+}
+
+func (ch *Chan) sendLoop() {
+	for {
+		select {
+		case msg, ok := <-ch.send:
+			if !ok {
+				if err := ch.framer.WriteMessage([]byte{chanEnd}); err != nil {
+					ch.fail(err)
+					return
+				}
+				// The write side of a server connection can not be closed, and the end
+				// message is enough for the other side.
+				if err := ch.conn.CloseWrite(); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+					ch.fail(err)
+				}
+				return
+			}
+			if err := ch.framer.WriteMessage(append([]byte{chanData}, msg...)); err != nil {
+				ch.fail(err)
+				return
+			}
+		case <-ch.conn.closed:
+			return
+		}
+	}
+}
+
+func (ch *Chan) recvLoop() {
+	defer close(ch.recv)
+	for {
+		msg, err := ch.framer.ReadMessage()
+		if err != nil {
+			if err != io.EOF {
+				ch.fail(err)
+			}
+			return
+		}
+		switch {
+		case len(msg) == 0:
+			ch.fail(fmt.Errorf("empty channel message"))
+			return
+		case msg[0] == chanEnd:
+			return
+		case msg[0] != chanData:
+			ch.fail(fmt.Errorf("invalid channel message type %d", msg[0]))
+			return
+		}
+		select {
+		case ch.recv <- msg[1:]:
+		case <-ch.conn.closed:
+			return
+		}
+	}
+}
+
+// fail stores the error and closes the connection, such that both loops are stopped.
+// Errors that are caused by a local close of the connection are ignored.
+func (ch *Chan) fail(err error) {
+	if isClosedChan(ch.conn.closed) {
+		return
+	}
+	ch.errOnce.Do(func() { ch.err = err })
+	ch.conn.Close()
+}
@@ -0,0 +1,103 @@
+package h2conn
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/posener/h2conn/h2test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestChan tests sending and receiving messages over channels
+func TestChan(t *testing.T) {
+	t.Parallel()
+
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverConn, err := Accept(w, r)
+		require.NoError(t, err)
+
+		// Echo the upper case of the received messages.
+		ch := NewChan(serverConn)
+		go func() {
+			defer close(ch.Send())
+			for msg := range ch.Recv() {
+				select {
+				case ch.Send() <- bytes.ToUpper(msg):
+				case <-ch.Done():
+					return
+				}
+			}
+		}()
+		<-r.Context().Done()
+		assert.NoError(t, ch.Err())
+	}))
+	defer server.Close()
+
+	clientConn, resp, err := insecureClient.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	ch := NewChan(clientConn)
+
+	msgs := []string{"hello", "", "world"}
+	go func() {
+		for _, msg := range msgs {
+			ch.Send() <- []byte(msg)
+		}
+		close(ch.Send())
+	}()
+
+	var got []string
+	for msg := range ch.Recv() {
+		got = append(got, string(msg))
+	}
+	<-ch.Done()
+	assert.NoError(t, ch.Err())
+	assert.Equal(t, []string{"HELLO", "", "WORLD"}, got)
+}
+
+// TestChanServerDoneFirst tests that the server can stop sending, and keep receiving the
+// messages of the client.
+func TestChanServerDoneFirst(t *testing.T) {
+	t.Parallel()
+
+	serverGot := make(chan []string, 1)
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverConn, err := Accept(w, r)
+		require.NoError(t, err)
+
+		ch := NewChan(serverConn)
+		ch.Send() <- []byte("bye")
+		close(ch.Send())
+		var got []string
+		for msg := range ch.Recv() {
+			got = append(got, string(msg))
+		}
+		serverGot <- got
+		<-ch.Done()
+		assert.NoError(t, ch.Err())
+	}))
+	defer server.Close()
+
+	clientConn, _, err := insecureClient.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	ch := NewChan(clientConn)
+
+	var got []string
+	for msg := range ch.Recv() {
+		got = append(got, string(msg))
+	}
+	assert.Equal(t, []string{"bye"}, got)
+
+	// The server still receives after it is done sending.
+	for _, msg := range []string{"hello", "", "world"} {
+		ch.Send() <- []byte(msg)
+	}
+	close(ch.Send())
+	<-ch.Done()
+	assert.NoError(t, ch.Err())
+	assert.Equal(t, []string{"hello", "", "world"}, <-serverGot)
+}
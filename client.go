@@ -2,8 +2,15 @@ package h2conn
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"time"
 
 	"golang.org/x/net/http2"
 )
@@ -16,8 +23,47 @@ type Client struct {
 	// Header enables sending custom headers to the server
 	Header http.Header
 	// Client is a custom HTTP client to be used for the connection.
-	// The client must have an http2.Transport as it's transport.
+	// The client must have an http2.Transport as it's transport, unless AllowHTTP1 is set.
 	Client *http.Client
+	// AllowHTTP1 enables full duplex communication with HTTP1.1 servers, using a chunked
+	// request body that is written while the response body is read.
+	// The server should be configured with Server.AllowHTTP1.
+	// If Client is not set, the default HTTP transport is used, which negotiates HTTP2 with
+	// servers that support it.
+	AllowHTTP1 bool
+	// Cleartext enables HTTP2 over plain TCP (h2c), with prior knowledge of the server
+	// HTTP2 support. The server should serve the handler with H2CHandler.
+	// If Client is not set, an HTTP2 transport that dials plain TCP connections is used.
+	// Otherwise, the given client transport should be configured for h2c.
+	Cleartext bool
+	// URLTemplate maps an address to a URL in DialContext.
+	// The "{network}", "{addr}", "{host}" and "{port}" placeholders are replaced with the
+	// dialed network and address, for example "https://edge.example.com/tunnel/{addr}".
+	// Values are escaped when they are placed after the host of the URL, such that an IPv6
+	// address is a single path segment.
+	// The default, if not set, is "https://{addr}".
+	URLTemplate string
+	// Protocols are the application protocols that the client supports, in order of
+	// preference. The protocol that was selected by the server is available with
+	// Conn.Protocol, and Connect fails if the server selected a protocol that is not one of
+	// them. The server might not select any protocol.
+	Protocols []string
+	// HeartbeatInterval, if set, enables in-band heartbeats when the server also enables
+	// them. A heartbeat is sent when nothing was written for this duration. If the server
+	// does not enable heartbeats, the connection is used without them.
+	HeartbeatInterval time.Duration
+	// HeartbeatTimeout is the duration in which nothing was received from the server, after
+	// which the connection is closed and its operations return ErrPeerUnresponsive. Heartbeats
+	// are received also when the connection is not read, unless data that was not read blocks
+	// them, in which case the connection is closed only if a write also made no progress.
+	// The default, if not set, is 3 times the HeartbeatInterval.
+	HeartbeatTimeout time.Duration
+	// RateLimit configures the rate limits of reads and writes of the connections.
+	// The default, if not set, is no limits.
+	RateLimit RateLimit
+	// Compression, if set, enables per-message compression when the server also enables it.
+	// If the server does not enable compression, the connection is used without it.
+	Compression *Compression
 }
 
 // Connect establishes a full duplex communication with an HTTP2 server with custom client.
@@ -25,46 +71,208 @@ type Client struct {
 func (c *Client) Connect(ctx context.Context, urlStr string) (*Conn, *http.Response, error) {
 	reader, writer := io.Pipe()
 
+	method := c.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
 	// Create a request object to send to the server
-	req, err := http.NewRequest(c.Method, urlStr, reader)
+	req, err := http.NewRequest(method, urlStr, reader)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Apply custom headers
 	if c.Header != nil {
-		req.Header = c.Header
+		req.Header = c.Header.Clone()
+	}
+	if len(c.Protocols) > 0 {
+		req.Header.Set(protocolHeader, strings.Join(c.Protocols, ", "))
+	}
+	// Declare the close trailers, which are set if the connection is closed with an error.
+	req.Trailer = http.Header{closeCodeTrailer: nil, closeReasonTrailer: nil}
+	if c.HeartbeatInterval > 0 {
+		req.Header.Set(heartbeatHeader, heartbeatTimeout(c.HeartbeatInterval, c.HeartbeatTimeout).String())
+	}
+	if c.Compression != nil {
+		req.Header.Set(compressionHeader, formatCompression(!c.Compression.NoContextTakeover))
 	}
-
-	// Apply given context to the sent request
-	req = req.WithContext(ctx)
 
 	// If an http client was not defined, use the default http client
 	httpClient := c.Client
 	if httpClient == nil {
-		httpClient = defaultClient.Client
+		switch {
+		case c.Cleartext:
+			httpClient = cleartextClient
+		case c.AllowHTTP1:
+			httpClient = http.DefaultClient
+		default:
+			httpClient = defaultClient.Client
+		}
+	}
+
+	// The http client timeout bounds the whole connection lifetime, apply it on the request
+	// context such that the request body will be released when it expires.
+	ctx, cancel := context.WithCancelCause(ctx)
+	if httpClient.Timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, httpClient.Timeout)
+		cancelCause := cancel
+		cancel = func(err error) {
+			cancelCause(err)
+			cancelTimeout()
+		}
 	}
 
+	// The transport might be blocked on reading the request body, even if the request
+	// failed. Release it when the request context is done.
+	go func() {
+		<-ctx.Done()
+		reader.CloseWithError(ctx.Err())
+	}()
+
+	// Collect the connection addresses.
+	localAddr, remoteAddr := net.Addr(addr("")), net.Addr(addr(req.URL.Host))
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			localAddr, remoteAddr = info.Conn.LocalAddr(), info.Conn.RemoteAddr()
+		},
+	}
+
+	// Apply given context to the sent request
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+
 	// Perform the request
 	resp, err := httpClient.Do(req)
 	if err != nil {
+		cancel(err)
 		return nil, nil, err
 	}
+	if resp.ProtoMajor < 2 && !c.AllowHTTP1 {
+		cancel(ErrHTTP2NotSupported)
+		resp.Body.Close()
+		return nil, nil, ErrHTTP2NotSupported
+	}
+	protocol := resp.Header.Get(protocolHeader)
+	if protocol != "" && selectProtocol([]string{protocol}, c.Protocols) == "" {
+		cancel(ErrProtocolNotSupported)
+		resp.Body.Close()
+		return nil, nil, ErrProtocolNotSupported
+	}
+	compress, contextTakeover := parseCompression(resp.Header)
+	if resp.Header.Get(compressionHeader) != "" && (!compress || c.Compression == nil) {
+		cancel(ErrCompressionNotSupported)
+		resp.Body.Close()
+		return nil, nil, ErrCompressionNotSupported
+	}
 
-	// Create a connection
-	conn, ctx := newConn(req.Context(), resp.Body, writer)
+	// Create a connection.
+	// Closing the connection does not cancel the request, the request ends when the server
+	// ends the response.
+	connCtx, connCancel := context.WithCancelCause(ctx)
+	body := &trailerReader{ReadCloser: resp.Body, trailer: func() http.Header { return resp.Trailer }}
+	conn := newConn(connCtx, connCancel, &responseBody{ReadCloser: body, done: cancel}, writer, localAddr, remoteAddr)
+	conn.header = resp.Header
+	conn.setCloseError = func(e *CloseError) { setCloseTrailer(req.Trailer, "", e) }
+	conn.endOnEOF = true
+	conn.protocol = protocol
+	if peerTimeout, ok := parseHeartbeat(resp.Header); ok && c.HeartbeatInterval > 0 {
+		conn.enableHeartbeat(c.HeartbeatInterval, heartbeatTimeout(c.HeartbeatInterval, c.HeartbeatTimeout), peerTimeout)
+	}
+	conn.enableRateLimit(c.RateLimit)
+	if compress {
+		conn.enableCompression(c.Compression, contextTakeover)
+	}
 
 	// Apply the connection context on the request context
-	resp.Request = req.WithContext(ctx)
+	resp.Request = req.WithContext(connCtx)
 
 	return conn, resp, nil
 }
 
+// DialContext connects to the address on the named network, by connecting to the URL that
+// is given by URLTemplate. It fails if the server did not respond with http.StatusOK.
+// It has the signature that is expected by grpc, ssh and http.Transport custom dialers.
+func (c *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	urlStr, err := c.dialURL(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, resp, err := c.Connect(ctx, urlStr)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("dial %s: bad status code %d", urlStr, resp.StatusCode)
+	}
+	return conn, nil
+}
+
+// dialURL returns the URL of a dialed address.
+func (c *Client) dialURL(network, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	tmpl := c.URLTemplate
+	if tmpl == "" {
+		tmpl = "https://{addr}"
+	}
+	// The values are placed as is in the host of the URL, and escaped in the rest of it.
+	split := 0
+	if i := strings.Index(tmpl, "://"); i >= 0 {
+		split = len(tmpl)
+		if j := strings.Index(tmpl[i+3:], "/"); j >= 0 {
+			split = i + 3 + j
+		}
+	}
+	raw := strings.NewReplacer("{network}", network, "{addr}", address, "{host}", host, "{port}", port)
+	escaped := strings.NewReplacer(
+		"{network}", url.PathEscape(network),
+		"{addr}", url.PathEscape(address),
+		"{host}", url.PathEscape(host),
+		"{port}", url.PathEscape(port),
+	)
+	return raw.Replace(tmpl[:split]) + escaped.Replace(tmpl[split:]), nil
+}
+
+// responseBody releases the request context when the response body is done.
+type responseBody struct {
+	io.ReadCloser
+	done context.CancelCauseFunc
+}
+
+// Close does not close the response body, since it resets the whole stream.
+// The body is released when the server ends the response.
+func (b *responseBody) Close() error {
+	return nil
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.done(err)
+	}
+	return n, err
+}
+
 var defaultClient = Client{
 	Method: http.MethodPost,
 	Client: &http.Client{Transport: &http2.Transport{}},
 }
 
+// cleartextClient is an HTTP2 client that dials h2c connections with prior knowledge.
+var cleartextClient = &http.Client{
+	Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	},
+}
+
 // Connect establishes a full duplex communication with an HTTP2 server.
 //
 // Usage:
@@ -0,0 +1,97 @@
+package h2conn
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Trailers in which the close code and reason are sent to the other side.
+const (
+	closeCodeTrailer   = "H2conn-Close-Code"
+	closeReasonTrailer = "H2conn-Close-Reason"
+)
+
+// Close codes that are sent by this package.
+const (
+	// CloseInternalError is the close code that is sent by Handler when the function returns
+	// an error which is not a *CloseError, or when it panics.
+	CloseInternalError uint32 = 1
+	// CloseGoingAway is the close code that is sent when the server shuts down. The client
+	// might connect to another server.
+	CloseGoingAway uint32 = 2
+)
+
+// CloseError is returned by Read when the other side closed the connection with
+// Conn.CloseWithError, after all the data that was sent before the close was read.
+// It can be inspected with errors.As:
+//
+//      var closeErr *h2conn.CloseError
+//      if errors.As(err, &closeErr) && closeErr.Code == codeShutdown {
+//          // Connect to another server.
+//      }
+//
+type CloseError struct {
+	// Code is an application defined code of the close reason.
+	Code uint32
+	// Reason is a human readable description of the close reason.
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("connection closed by peer with code %d", e.Code)
+	}
+	return fmt.Sprintf("connection closed by peer with code %d: %s", e.Code, e.Reason)
+}
+
+// CloseWithError closes the connection, and sends the code and reason to the other side,
+// which will get a *CloseError from Read after reading the remaining data.
+// The reason is not sent if the write side of the connection was already closed.
+//
+// On the server side, the reason is sent in the response trailers, when the http handler
+// returns. On the client side, it is sent in the request trailers.
+func (c *Conn) CloseWithError(code uint32, reason string) error {
+	return c.closeWithCause(net.ErrClosed, &CloseError{Code: code, Reason: reason})
+}
+
+// setCloseTrailer sets the close code and reason in the trailer header.
+func setCloseTrailer(trailer http.Header, prefix string, e *CloseError) {
+	trailer.Set(prefix+closeCodeTrailer, strconv.FormatUint(uint64(e.Code), 10))
+	trailer.Set(prefix+closeReasonTrailer, url.QueryEscape(e.Reason))
+}
+
+// parseCloseTrailer returns the close error from the trailer header, or nil if the other side
+// did not close the connection with an error.
+func parseCloseTrailer(trailer http.Header) *CloseError {
+	code, err := strconv.ParseUint(trailer.Get(closeCodeTrailer), 10, 32)
+	if err != nil {
+		return nil
+	}
+	reason, err := url.QueryUnescape(trailer.Get(closeReasonTrailer))
+	if err != nil {
+		reason = trailer.Get(closeReasonTrailer)
+	}
+	return &CloseError{Code: uint32(code), Reason: reason}
+}
+
+// trailerReader returns a *CloseError instead of io.EOF, if the other side sent a close
+// error in the trailers.
+type trailerReader struct {
+	io.ReadCloser
+	// trailer returns the trailer header, which is available after the body was read.
+	trailer func() http.Header
+}
+
+func (r *trailerReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		if e := parseCloseTrailer(r.trailer()); e != nil {
+			return n, e
+		}
+	}
+	return n, err
+}
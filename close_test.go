@@ -0,0 +1,120 @@
+package h2conn
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/posener/h2conn/h2test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestServerCloseWithError tests that the client gets the close error of the server after
+// reading the remaining data.
+func TestServerCloseWithError(t *testing.T) {
+	t.Parallel()
+
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Accept(w, r)
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("bye"))
+		require.NoError(t, err)
+		require.NoError(t, conn.CloseWithError(1, "shutting down"))
+
+		_, err = conn.Write([]byte("bye"))
+		assert.Equal(t, net.ErrClosed, err)
+	}))
+	defer server.Close()
+
+	conn, _, err := insecureClient.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	got, err := io.ReadAll(conn)
+	assert.Equal(t, "bye", string(got))
+	var closeErr *CloseError
+	require.True(t, errors.As(err, &closeErr), "got error: %v", err)
+	assert.Equal(t, &CloseError{Code: 1, Reason: "shutting down"}, closeErr)
+	assert.Equal(t, "connection closed by peer with code 1: shutting down", err.Error())
+}
+
+// TestClientCloseWithError tests that the server gets the close error of the client after
+// reading the remaining data.
+func TestClientCloseWithError(t *testing.T) {
+	t.Parallel()
+
+	const reason = "policy violation:\nspam"
+	serverErr := make(chan error, 1)
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Accept(w, r)
+		require.NoError(t, err)
+		defer conn.Close()
+		got, err := io.ReadAll(conn)
+		assert.Equal(t, "hello", string(got))
+		serverErr <- err
+	}))
+	defer server.Close()
+
+	conn, _, err := insecureClient.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWithError(2, reason))
+
+	err = <-serverErr
+	var closeErr *CloseError
+	require.True(t, errors.As(err, &closeErr), "got error: %v", err)
+	assert.Equal(t, &CloseError{Code: 2, Reason: reason}, closeErr)
+}
+
+// TestCloseWithErrorAfterCloseWrite tests that the close error is not sent after the write side
+// was closed.
+func TestCloseWithErrorAfterCloseWrite(t *testing.T) {
+	t.Parallel()
+
+	serverErr := make(chan error, 1)
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Accept(w, r)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = io.ReadAll(conn)
+		serverErr <- err
+	}))
+	defer server.Close()
+
+	conn, _, err := insecureClient.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	require.NoError(t, conn.CloseWrite())
+	require.NoError(t, conn.CloseWithError(2, "too late"))
+	assert.NoError(t, <-serverErr)
+}
+
+// TestCloseWithErrorBlockedWrite tests that a write that is blocked by flow control does not
+// block CloseWithError.
+func TestCloseWithErrorBlockedWrite(t *testing.T) {
+	t.Parallel()
+
+	server, serverAccepted, serverHandlerWait := startServer()
+	defer server.Close()
+	defer close(serverHandlerWait)
+
+	conn, _, err := insecureClient.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	<-serverAccepted
+
+	// The server does not read, so the write blocks.
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(make([]byte, 10*1024*1024))
+		writeErr <- err
+	}()
+	time.Sleep(shortDuration)
+
+	require.NoError(t, conn.CloseWithError(1, "bye"))
+	assert.Equal(t, net.ErrClosed, <-writeErr)
+}
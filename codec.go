@@ -0,0 +1,40 @@
+package h2conn
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"io"
+)
+
+// Codec creates encoders and decoders of values over a stream of bytes.
+type Codec interface {
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+}
+
+// Encoder encodes values to a stream of bytes.
+type Encoder interface {
+	Encode(v interface{}) error
+}
+
+// Decoder decodes values from a stream of bytes.
+type Decoder interface {
+	Decode(v interface{}) error
+}
+
+var (
+	// JSON is a codec that uses the encoding/json format.
+	JSON Codec = jsonCodec{}
+	// Gob is a codec that uses the encoding/gob format.
+	Gob Codec = gobCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) NewEncoder(w io.Writer) Encoder { return json.NewEncoder(w) }
+func (jsonCodec) NewDecoder(r io.Reader) Decoder { return json.NewDecoder(r) }
+
+type gobCodec struct{}
+
+func (gobCodec) NewEncoder(w io.Writer) Encoder { return gob.NewEncoder(w) }
+func (gobCodec) NewDecoder(r io.Reader) Decoder { return gob.NewDecoder(r) }
@@ -0,0 +1,319 @@
+package h2conn
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrCompressionNotSupported is returned by Connect if the server selected a compression that
+// the client does not support.
+var ErrCompressionNotSupported = errors.New("compression not supported")
+
+// compressionHeader is the header in which the client offers compression, and the server
+// responds with the selected compression and its parameters.
+const compressionHeader = "H2conn-Compression"
+
+// Compression algorithms and parameters of the compression header.
+const (
+	compressionDeflate   = "deflate"
+	noContextTakeover    = "no_context_takeover"
+	defaultMinCompressed = 128
+	// flateWindow is the size of the flate window, which is the dictionary of a message when
+	// the context is taken over from previous messages.
+	flateWindow = 32 << 10
+)
+
+// deflateTail is the end of the empty stored block that ends a flushed flate stream. It is not
+// sent, and is added back by the reader, followed by a final empty stored block, such that
+// reading a message ends with io.EOF.
+var (
+	deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+	messageEnd  = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+)
+
+// Message types of compressed connections. Each write to the connection is sent as a message,
+// which is compressed if it is large enough.
+const (
+	messagePlain byte = iota
+	messageCompressed
+)
+
+// Compression configures per-message compression of a connection with compress/flate.
+//
+// Each write to the connection is compressed separately and flushed, such that messages are
+// not delayed by buffering, as happens when the whole stream is compressed. When the
+// compression context is taken over, messages are compressed with the data of previous
+// messages as a dictionary, which is efficient for streams of similar messages, such as JSON
+// events.
+type Compression struct {
+	// Level is the flate compression level of written messages.
+	// The default, if not set, is flate.DefaultCompression.
+	Level int
+	// MinSize is the minimal size of a written message that is compressed. Smaller messages
+	// are sent uncompressed.
+	// The default, if not set, is 128 bytes.
+	MinSize int
+	// NoContextTakeover compresses each message independently of previous messages, in both
+	// directions, if either side sets it. It reduces the memory that is kept between messages,
+	// at the cost of worse compression.
+	NoContextTakeover bool
+}
+
+// formatCompression returns the compression header value.
+func formatCompression(contextTakeover bool) string {
+	if !contextTakeover {
+		return compressionDeflate + "; " + noContextTakeover
+	}
+	return compressionDeflate
+}
+
+// parseCompression returns whether deflate compression was offered or selected in the
+// compression header, and whether the compression context is taken over.
+func parseCompression(h http.Header) (ok, contextTakeover bool) {
+	for _, v := range h.Values(compressionHeader) {
+		for _, offer := range strings.Split(v, ",") {
+			params := strings.Split(offer, ";")
+			if strings.TrimSpace(params[0]) != compressionDeflate {
+				continue
+			}
+			contextTakeover = true
+			for _, p := range params[1:] {
+				if strings.TrimSpace(p) == noContextTakeover {
+					contextTakeover = false
+				}
+			}
+			return true, contextTakeover
+		}
+	}
+	return false, false
+}
+
+// enableCompression enables per-message compression on the connection.
+// It should be called before the connection is used, and after the rate limits are enabled,
+// such that the rate limits apply to the compressed data.
+func (c *Conn) enableCompression(cfg *Compression, contextTakeover bool) {
+	level := cfg.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	minSize := cfg.MinSize
+	if minSize <= 0 {
+		minSize = defaultMinCompressed
+	}
+	c.r = &compressReader{r: c.r, br: bufio.NewReader(c.r), contextTakeover: contextTakeover}
+	c.wc = &compressWriter{wc: c.wc, level: level, minSize: minSize, contextTakeover: contextTakeover}
+}
+
+// compressReader reads messages and decompresses them.
+type compressReader struct {
+	r               io.ReadCloser
+	br              *bufio.Reader
+	contextTakeover bool
+
+	// remaining is the number of bytes left in the current plain message.
+	remaining uint64
+	// compressed is true while a compressed message is read from src with fr.
+	compressed bool
+	fr         io.ReadCloser
+	src        messageSource
+	// window holds the recently decompressed data, which is the dictionary of the next
+	// message when the context is taken over.
+	window []byte
+}
+
+func (c *compressReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		switch {
+		case c.compressed:
+			n, err := c.fr.Read(p)
+			if c.contextTakeover {
+				c.remember(p[:n])
+			}
+			if err == io.EOF {
+				if c.src.remaining > 0 || len(c.src.tail) > 0 {
+					return n, errors.New("invalid compressed message")
+				}
+				c.compressed = false
+				err = nil
+			}
+			if n > 0 || err != nil {
+				return n, unexpectedEOF(err)
+			}
+		case c.remaining > 0:
+			if uint64(len(p)) > c.remaining {
+				p = p[:c.remaining]
+			}
+			n, err := c.br.Read(p)
+			c.remaining -= uint64(n)
+			return n, unexpectedEOF(err)
+		default:
+			if err := c.next(); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// next reads the header of the next message.
+func (c *compressReader) next() error {
+	typ, err := c.br.ReadByte()
+	if err != nil {
+		return err
+	}
+	size, err := binary.ReadUvarint(c.br)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	switch typ {
+	case messagePlain:
+		c.remaining = size
+	case messageCompressed:
+		c.src = messageSource{br: c.br, remaining: size, tail: messageEnd}
+		var dict []byte
+		if c.contextTakeover && len(c.window) > flateWindow {
+			dict = c.window[len(c.window)-flateWindow:]
+		} else if c.contextTakeover {
+			dict = c.window
+		}
+		if c.fr == nil {
+			c.fr = flate.NewReaderDict(&c.src, dict)
+		} else if err := c.fr.(flate.Resetter).Reset(&c.src, dict); err != nil {
+			return err
+		}
+		c.compressed = true
+	default:
+		return fmt.Errorf("invalid message type %d", typ)
+	}
+	return nil
+}
+
+// remember adds decompressed data to the window.
+func (c *compressReader) remember(p []byte) {
+	c.window = append(c.window, p...)
+	if len(c.window) >= 2*flateWindow {
+		c.window = append(c.window[:0], c.window[len(c.window)-flateWindow:]...)
+	}
+}
+
+func (c *compressReader) Close() error {
+	return c.r.Close()
+}
+
+// messageSource reads the compressed data of a message, followed by the tail.
+// It implements io.ByteReader such that the flate reader does not read beyond the message.
+type messageSource struct {
+	br        *bufio.Reader
+	remaining uint64
+	tail      []byte
+}
+
+func (s *messageSource) Read(p []byte) (int, error) {
+	if s.remaining == 0 {
+		if len(s.tail) == 0 {
+			return 0, io.EOF
+		}
+		n := copy(p, s.tail)
+		s.tail = s.tail[n:]
+		return n, nil
+	}
+	if uint64(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.br.Read(p)
+	s.remaining -= uint64(n)
+	return n, unexpectedEOF(err)
+}
+
+func (s *messageSource) ReadByte() (byte, error) {
+	if s.remaining == 0 {
+		if len(s.tail) == 0 {
+			return 0, io.EOF
+		}
+		b := s.tail[0]
+		s.tail = s.tail[1:]
+		return b, nil
+	}
+	b, err := s.br.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	s.remaining--
+	return b, nil
+}
+
+// compressWriter writes each write as a message, which is compressed if it is large enough.
+type compressWriter struct {
+	wc              io.WriteCloser
+	level           int
+	minSize         int
+	contextTakeover bool
+
+	// fw is created on the first compressed message.
+	fw  *flate.Writer
+	out bytes.Buffer
+	buf []byte
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	typ, data := messagePlain, p
+	if len(p) >= c.minSize {
+		var err error
+		if data, err = c.compress(p); err != nil {
+			return 0, err
+		}
+		typ = messageCompressed
+	}
+	c.buf = append(c.buf[:0], typ)
+	c.buf = binary.AppendUvarint(c.buf, uint64(len(data)))
+	c.buf = append(c.buf, data...)
+	if _, err := c.wc.Write(c.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// compress returns the compressed message, without the flate tail.
+func (c *compressWriter) compress(p []byte) ([]byte, error) {
+	c.out.Reset()
+	switch {
+	case c.fw == nil:
+		fw, err := flate.NewWriter(&c.out, c.level)
+		if err != nil {
+			return nil, err
+		}
+		c.fw = fw
+	case !c.contextTakeover:
+		c.fw.Reset(&c.out)
+	}
+	if _, err := c.fw.Write(p); err != nil {
+		return nil, err
+	}
+	if err := c.fw.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(c.out.Bytes(), deflateTail), nil
+}
+
+func (c *compressWriter) Flush() error {
+	if f, ok := c.wc.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (c *compressWriter) Close() error {
+	return c.wc.Close()
+}
@@ -0,0 +1,172 @@
+package h2conn
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/posener/h2conn/h2test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (*bufferCloser) Close() error { return nil }
+
+// events returns messages that look like a JSON event stream, some of them smaller than the
+// default compression threshold.
+func events(n int) [][]byte {
+	var msgs [][]byte
+	for i := 0; i < n; i++ {
+		if i%5 == 0 {
+			msgs = append(msgs, []byte(fmt.Sprintf(`{"ping":%d}`, i)))
+			continue
+		}
+		msgs = append(msgs, []byte(fmt.Sprintf(
+			`{"id":%d,"type":"order.updated","status":"shipped","customer":{"name":"customer-%d","country":"US"},"items":[{"sku":"A-%d","quantity":%d}]}`,
+			i, i%7, i%13, i%3)))
+	}
+	return msgs
+}
+
+func TestCompressMessages(t *testing.T) {
+	t.Parallel()
+
+	msgs := events(200)
+	var raw []byte
+	for _, msg := range msgs {
+		raw = append(raw, msg...)
+	}
+
+	for _, contextTakeover := range []bool{true, false} {
+		contextTakeover := contextTakeover
+		t.Run(fmt.Sprintf("contextTakeover=%v", contextTakeover), func(t *testing.T) {
+			t.Parallel()
+
+			wire := &bufferCloser{}
+			c := &Conn{r: io.NopCloser(wire), wc: wire}
+			c.enableCompression(&Compression{}, contextTakeover)
+
+			for _, msg := range msgs {
+				n, err := c.wc.Write(msg)
+				require.NoError(t, err)
+				assert.Equal(t, len(msg), n)
+			}
+			size := wire.Len()
+			t.Logf("compressed %d bytes to %d bytes", len(raw), size)
+			assert.True(t, size < len(raw), "compressed size %d", size)
+			// Similar messages are compressed well when the context is taken over.
+			if contextTakeover {
+				assert.True(t, size < len(raw)/5, "compressed size %d", size)
+			}
+
+			got, err := io.ReadAll(c.r)
+			require.NoError(t, err)
+			assert.Equal(t, raw, got)
+		})
+	}
+}
+
+func TestCompressInvalidMessage(t *testing.T) {
+	t.Parallel()
+
+	wire := &bufferCloser{}
+	wire.Write([]byte{messageCompressed, 3, 'a', 'b', 'c'})
+	c := &Conn{r: io.NopCloser(wire), wc: wire}
+	c.enableCompression(&Compression{}, true)
+
+	_, err := io.ReadAll(c.r)
+	assert.Error(t, err)
+}
+
+func TestCompression(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name           string
+		server, client *Compression
+		wantHeader     string
+	}{
+		{
+			name:       "context takeover",
+			server:     &Compression{},
+			client:     &Compression{},
+			wantHeader: "deflate",
+		},
+		{
+			name:       "client no context takeover",
+			server:     &Compression{},
+			client:     &Compression{NoContextTakeover: true, MinSize: 1},
+			wantHeader: "deflate; no_context_takeover",
+		},
+		{
+			name:       "server no context takeover",
+			server:     &Compression{NoContextTakeover: true, Level: 1},
+			client:     &Compression{},
+			wantHeader: "deflate; no_context_takeover",
+		},
+		{
+			name:   "server only",
+			server: &Compression{},
+		},
+		{
+			name:   "client only",
+			client: &Compression{},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			u := Server{Compression: tt.server}
+			server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := u.Accept(w, r)
+				require.NoError(t, err)
+				defer conn.Close()
+				_, err = io.Copy(conn, conn)
+				assert.NoError(t, err)
+			}))
+			defer server.Close()
+
+			cl := insecureClient
+			cl.Compression = tt.client
+			conn, resp, err := cl.Connect(context.Background(), server.URL)
+			require.NoError(t, err)
+			defer conn.Close()
+			assert.Equal(t, tt.wantHeader, resp.Header.Get(compressionHeader))
+
+			for _, msg := range events(50) {
+				_, err = conn.Write(msg)
+				require.NoError(t, err)
+				got := make([]byte, len(msg))
+				_, err = io.ReadFull(conn, got)
+				require.NoError(t, err)
+				assert.Equal(t, string(msg), string(got))
+			}
+		})
+	}
+}
+
+func TestCompressionNotSupported(t *testing.T) {
+	t.Parallel()
+
+	u := Server{Header: http.Header{compressionHeader: []string{"gzip"}}}
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := u.Accept(w, r)
+		require.NoError(t, err)
+	}))
+	defer server.Close()
+
+	cl := insecureClient
+	cl.Compression = &Compression{}
+	_, _, err := cl.Connect(context.Background(), server.URL)
+	assert.Equal(t, ErrCompressionNotSupported, err)
+}
@@ -2,48 +2,541 @@ package h2conn
 
 import (
 	"context"
+	"errors"
 	"io"
+	"net"
+	"net/http"
+	"os"
 	"sync"
+	"time"
 )
 
 // Conn is client/server symmetric connection.
-// It implements the io.Reader/io.Writer/io.Closer to read/write or close the connection to the other side.
-// It also has a Send/Recv function to use channels to communicate with the other side.
+// It implements the net.Conn interface to read/write or close the connection to the other side.
+// It can also be wrapped with NewChan to use channels to communicate with the other side.
 type Conn struct {
-	r  io.Reader
+	// r reads from the other side, closing it closes the read side of the connection.
+	r io.ReadCloser
+	// wc writes to the other side, closing it closes the write side of the connection.
 	wc io.WriteCloser
 
-	cancel context.CancelFunc
+	// ctx is done when the connection ends, with the reason as its cause.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	// goingAway is closed when the server starts shutting down.
+	goingAway chan struct{}
+	// endOnEOF is set on the client side, where the end of the response ends the stream.
+	// On the server side the end of the request only closes the read side.
+	endOnEOF bool
+	// noCloseWrite is set on the server side, where the response stream can not be ended
+	// before the http handler returns.
+	noCloseWrite bool
+
+	localAddr, remoteAddr net.Addr
+
+	// header is the header that was sent by the other side.
+	header http.Header
+	// principal is the authenticated principal of the client.
+	principal interface{}
+	// protocol is the negotiated application protocol.
+	protocol string
+
+	readDeadline, writeDeadline deadline
+
+	// closed is closed when the connection is closed.
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	// closeCause is returned by operations after the connection is closed.
+	closeCause error
+	// setCloseError sets the close error that is sent to the other side, it is called with
+	// closeMu held before the write side is closed.
+	setCloseError func(*CloseError)
+	// closeMu guards the closing of the write side, such that the close error is not set
+	// after it was closed. It does not block on pending writes.
+	closeMu sync.Mutex
+	// resetStream, if set, resets the server stream, which is otherwise ended only when the
+	// http handler returns. It also interrupts a pending write to the underlying writer,
+	// which might be blocked forever by flow control.
+	resetStream func()
 
 	wLock sync.Mutex
 	rLock sync.Mutex
+
+	// Read state, guarded by rLock.
+	// Reads from the underlying reader are done in a background goroutine, such that they
+	// could be abandoned when a deadline is exceeded. An abandoned read result is kept for
+	// the next Read call.
+	rBuf     []byte // rBuf is the buffer used by the background read.
+	rData    []byte // rData is data that was read but not yet consumed.
+	rErr     error
+	rPending bool
+	rDone    chan ioResult
+
+	// rClosed is closed when the read side of the connection is closed.
+	rClosed    chan struct{}
+	rCloseOnce sync.Once
+
+	// Write state, guarded by wLock.
+	// Writes and flushes of the underlying writer are done in a background goroutine, such
+	// that they could be abandoned when a deadline is exceeded. The written data is copied,
+	// such that an abandoned write does not use the caller's buffer.
+	wBuf     []byte
+	wErr     error
+	wPending bool
+	wDone    chan error
+	wClosed  bool // wClosed is also guarded by closeMu when it is set.
+
+	// Flush policy of buffered writes, guarded by wLock.
+	flushSize     int
+	flushInterval time.Duration
+	flushTimer    *time.Timer
+	unflushed     int
+}
+
+// flusher is implemented by underlying writers that buffer the written data.
+type flusher interface {
+	Flush() error
 }
 
-func newConn(ctx context.Context, r io.Reader, wc io.WriteCloser) (*Conn, context.Context) {
-	ctx, cancel := context.WithCancel(ctx)
+type ioResult struct {
+	n   int
+	err error
+}
+
+// readBufSize is the minimal size of the buffer used for reading from the underlying reader.
+const readBufSize = 32 * 1024
+
+// closeResetDelay is the time after a server connection is closed, in which the http handler
+// can return and end the stream normally, before the stream is reset.
+const closeResetDelay = 100 * time.Millisecond
+
+func newConn(ctx context.Context, cancel context.CancelCauseFunc, r io.ReadCloser, wc io.WriteCloser, localAddr, remoteAddr net.Addr) *Conn {
 	return &Conn{
-		r:      r,
-		wc:     wc,
-		cancel: cancel,
-	}, ctx
+		r:             r,
+		wc:            wc,
+		ctx:           ctx,
+		cancel:        cancel,
+		localAddr:     localAddr,
+		remoteAddr:    remoteAddr,
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+		closed:        make(chan struct{}),
+		goingAway:     make(chan struct{}),
+		rDone:         make(chan ioResult, 1),
+		rClosed:       make(chan struct{}),
+		wDone:         make(chan error, 1),
+	}
 }
 
 // Write writes data to the connection
 func (c *Conn) Write(data []byte) (int, error) {
 	c.wLock.Lock()
 	defer c.wLock.Unlock()
-	return c.wc.Write(data)
+
+	if c.wClosed {
+		return 0, net.ErrClosed
+	}
+	if err := c.checkOp(&c.writeDeadline); err != nil {
+		return 0, err
+	}
+
+	// Wait for a previously abandoned write to complete.
+	if err := c.waitWrite(); err != nil {
+		return 0, err
+	}
+
+	c.wBuf = append(c.wBuf[:0], data...)
+	buf := c.wBuf
+	c.startWrite(func() error {
+		_, err := c.wc.Write(buf)
+		return err
+	})
+	if err := c.waitWrite(); err != nil {
+		return 0, err
+	}
+
+	if c.flushSize > 0 || c.flushInterval > 0 {
+		c.unflushed += len(data)
+		switch {
+		case c.flushSize > 0 && c.unflushed >= c.flushSize:
+			if err := c.flush(); err != nil {
+				return len(data), err
+			}
+		case c.flushInterval > 0 && c.flushTimer == nil:
+			c.flushTimer = time.AfterFunc(c.flushInterval, c.autoFlush)
+		}
+	}
+	return len(data), nil
+}
+
+// Flush sends any buffered data to the other side.
+// Data is buffered only on the server side, when the Server is configured with BufferWrites.
+func (c *Conn) Flush() error {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+
+	if err := c.checkOp(&c.writeDeadline); err != nil {
+		return err
+	}
+	if err := c.waitWrite(); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// flush flushes the underlying writer.
+// It should be called with the write lock held and no pending write.
+func (c *Conn) flush() error {
+	c.stopFlushTimer()
+	c.unflushed = 0
+	f, ok := c.wc.(flusher)
+	if !ok {
+		return nil
+	}
+	c.startWrite(f.Flush)
+	return c.waitWrite()
+}
+
+// autoFlush is called when the flush interval has passed since the first unflushed write.
+// It does not wait for the flush to complete, the next write will wait for it.
+func (c *Conn) autoFlush() {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+
+	c.flushTimer = nil
+	if isClosedChan(c.closed) || c.unflushed == 0 {
+		return
+	}
+	if c.wPending {
+		// An abandoned write is still in progress, try again later.
+		c.flushTimer = time.AfterFunc(c.flushInterval, c.autoFlush)
+		return
+	}
+	c.unflushed = 0
+	if f, ok := c.wc.(flusher); ok {
+		c.startWrite(f.Flush)
+	}
+}
+
+func (c *Conn) stopFlushTimer() {
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+}
+
+// startWrite runs an operation on the underlying writer in the background.
+// It should be called with the write lock held and no pending write.
+func (c *Conn) startWrite(op func() error) {
+	c.wPending = true
+	go func() {
+		c.wDone <- op()
+	}()
+}
+
+// waitWrite waits for the pending write operation to complete.
+// It returns an error if the operation was abandoned or if any write operation failed.
+// It should be called with the write lock held.
+func (c *Conn) waitWrite() error {
+	if !c.wPending {
+		return c.wErr
+	}
+	select {
+	case err := <-c.wDone:
+		c.wPending = false
+		if err != nil && c.wErr == nil {
+			c.wErr = err
+		}
+		return c.wErr
+	case <-c.writeDeadline.wait():
+		return os.ErrDeadlineExceeded
+	case <-c.closed:
+		return c.closeCause
+	}
 }
 
 // Read reads data from the connection
 func (c *Conn) Read(data []byte) (int, error) {
 	c.rLock.Lock()
 	defer c.rLock.Unlock()
-	return c.r.Read(data)
+
+	for {
+		if isClosedChan(c.rClosed) {
+			return 0, net.ErrClosed
+		}
+		if len(c.rData) > 0 {
+			n := copy(data, c.rData)
+			c.rData = c.rData[n:]
+			return n, nil
+		}
+		if c.rErr != nil {
+			return 0, c.rErr
+		}
+		if err := c.checkOp(&c.readDeadline); err != nil {
+			return 0, err
+		}
+		if len(data) == 0 {
+			return 0, nil
+		}
+
+		if !c.rPending {
+			size := len(data)
+			if size < readBufSize {
+				size = readBufSize
+			}
+			if cap(c.rBuf) < size {
+				c.rBuf = make([]byte, size)
+			}
+			c.rPending = true
+			go func(buf []byte) {
+				n, err := c.r.Read(buf)
+				c.rDone <- ioResult{n: n, err: err}
+			}(c.rBuf[:size])
+		}
+
+		select {
+		case res := <-c.rDone:
+			c.rPending = false
+			c.rData = c.rBuf[:res.n]
+			c.rErr = res.err
+			if res.err != nil && (res.err != io.EOF || c.endOnEOF) {
+				// The other side ended the connection, or the stream failed.
+				c.closeWithCause(res.err, nil)
+			}
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, c.closeCause
+		case <-c.rClosed:
+			return 0, net.ErrClosed
+		}
+	}
 }
 
-// Close closes the connection
+// checkOp checks if a read or write operation can be performed.
+func (c *Conn) checkOp(d *deadline) error {
+	switch {
+	case isClosedChan(c.closed):
+		return c.closeCause
+	case isClosedChan(d.wait()):
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// Close closes the connection.
+// Any blocked Read or Write operations will be unblocked and return errors.
+//
+// On the server side, the stream is ended when the http handler returns. If the handler does
+// not return shortly after the close, for example when the connection was closed by another
+// goroutine, the stream is reset with RST_STREAM.
 func (c *Conn) Close() error {
-	c.cancel()
+	return c.closeWithCause(net.ErrClosed, nil)
+}
+
+// closeWithCause closes the connection, such that operations return the given error.
+// If sent is not nil, it is sent to the other side, unless the write side was already closed.
+func (c *Conn) closeWithCause(cause error, sent *CloseError) error {
+	c.closeOnce.Do(func() {
+		if sent != nil && c.setCloseError != nil {
+			c.closeMu.Lock()
+			if !c.wClosed {
+				c.setCloseError(sent)
+			}
+			c.closeMu.Unlock()
+		}
+		c.closeCause = cause
+		close(c.closed)
+		c.closeErr = c.wc.Close()
+		if err := c.r.Close(); c.closeErr == nil {
+			c.closeErr = err
+		}
+
+		// On the server side, the http handler may return when the connection context is
+		// done, and the response writer must not be used after it returns. The context is
+		// therefore canceled only after an abandoned write is done.
+		c.wLock.Lock()
+		c.stopFlushTimer()
+		pending := c.wPending
+		if pending {
+			// Collect a write that is already done, such as a heartbeat.
+			select {
+			case <-c.wDone:
+				pending = false
+			default:
+			}
+		}
+		c.wLock.Unlock()
+		if c.resetStream != nil {
+			if pending {
+				c.resetStream()
+			} else {
+				time.AfterFunc(closeResetDelay, c.resetStream)
+			}
+		}
+		if !pending {
+			c.cancel(cause)
+			return
+		}
+		go func() {
+			<-c.wDone
+			c.cancel(cause)
+		}()
+	})
+	return c.closeErr
+}
+
+// CloseWrite shuts down the writing side of the connection.
+// The other side will read the remaining data and then get an io.EOF, and can keep
+// sending data which can be read on this side.
+//
+// On the client side, it ends the request body.
+// On the server side, the response stream is ended only when the http handler returns, so
+// the other side can not get an io.EOF while the connection is open. CloseWrite returns
+// errors.ErrUnsupported, and the connection should be closed instead.
+func (c *Conn) CloseWrite() error {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	if isClosedChan(c.closed) {
+		return net.ErrClosed
+	}
+	if c.noCloseWrite {
+		return errors.ErrUnsupported
+	}
+	if c.wClosed {
+		return nil
+	}
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	c.wClosed = true
 	return c.wc.Close()
 }
+
+// CloseRead shuts down the reading side of the connection.
+// Any blocked Read operation will be unblocked and return an error, and the other side can
+// keep reading data that is written on this side.
+// Data that is sent by the other side is discarded.
+func (c *Conn) CloseRead() error {
+	if isClosedChan(c.closed) {
+		return net.ErrClosed
+	}
+	c.rCloseOnce.Do(func() {
+		close(c.rClosed)
+
+		// Discard incoming data, such that the other side will not be blocked by the flow control.
+		c.rLock.Lock()
+		pending := c.rPending
+		c.rPending = false
+		c.rLock.Unlock()
+		go func() {
+			if pending {
+				<-c.rDone
+			}
+			io.Copy(io.Discard, c.r)
+		}()
+	})
+	return nil
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// Header returns the header that was sent by the other side: the request header on the
+// server side, and the response header on the client side.
+func (c *Conn) Header() http.Header {
+	return c.header
+}
+
+// Principal returns the principal of the client that was authenticated by the
+// Server.Authenticator, or nil if the connection was not authenticated.
+func (c *Conn) Principal() interface{} {
+	return c.principal
+}
+
+// Protocol returns the application protocol that was selected by the server from the
+// protocols of the client, or an empty string if no protocol was selected.
+func (c *Conn) Protocol() string {
+	return c.protocol
+}
+
+// Context returns the context of the connection, which is done when the connection ends.
+// On the server side it is also the context of the request, and on the client side it is
+// also the context of the response request.
+func (c *Conn) Context() context.Context {
+	return c.ctx
+}
+
+// Done returns a channel that is closed when the connection ends, either by this side or by
+// the other side. The end of the connection by the other side is detected by Read.
+func (c *Conn) Done() <-chan struct{} {
+	return c.ctx.Done()
+}
+
+// GoingAway returns a channel that is closed when the server that accepted the connection
+// starts shutting down, such that the handler can finish its work and close the connection.
+// It is never closed on the client side.
+func (c *Conn) GoingAway() <-chan struct{} {
+	return c.goingAway
+}
+
+// Err returns nil if Done is not yet closed. Otherwise, it returns the reason that the
+// connection ended:
+//
+//   - net.ErrClosed if it was closed by this side.
+//   - ErrPeerUnresponsive if the other side did not send heartbeats.
+//   - io.EOF or *CloseError if it was closed by the other side. On the server side, an io.EOF
+//     only closes the read side, since the client might still read.
+//   - The cause of the context, if the context of the connection was canceled.
+//   - The error of the underlying stream otherwise.
+func (c *Conn) Err() error {
+	if c.ctx.Err() == nil {
+		return nil
+	}
+	return context.Cause(c.ctx)
+}
+
+// SetDeadline sets the read and write deadlines associated with the connection.
+// It is equivalent to calling both SetReadDeadline and SetWriteDeadline.
+// A deadline is an absolute time after which I/O operations fail with os.ErrDeadlineExceeded
+// instead of blocking. A zero value for t means I/O operations will not time out.
+func (c *Conn) SetDeadline(t time.Time) error {
+	if isClosedChan(c.closed) {
+		return net.ErrClosed
+	}
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for future Read calls and any currently-blocked Read call.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	if isClosedChan(c.closed) {
+		return net.ErrClosed
+	}
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future Write calls and any currently-blocked Write call.
+// Data of a write that timed out may still be delivered to the other side.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	if isClosedChan(c.closed) {
+		return net.ErrClosed
+	}
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// addr is a net.Addr of an endpoint of an HTTP connection.
+type addr string
+
+func (a addr) Network() string { return "tcp" }
+func (a addr) String() string  { return string(a) }
@@ -8,11 +8,15 @@ import (
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -147,6 +151,308 @@ func TestServerClose(t *testing.T) {
 	assert.Equal(t, 0, n)
 }
 
+// TestServerCloseBackground tests that a server close from a goroutine other than the handler
+// ends the stream.
+func TestServerCloseBackground(t *testing.T) {
+	t.Parallel()
+
+	serverReadErr := make(chan error, 1)
+
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverConn, err := Accept(w, r)
+		require.NoError(t, err)
+		go func() {
+			_, err := serverConn.Write([]byte("hello"))
+			assert.NoError(t, err)
+			serverConn.Close()
+			_, err = serverConn.Read(make([]byte, 100))
+			serverReadErr <- err
+		}()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	clientConn, resp, err := insecureClient.Connect(context.Background(), server.URL)
+	require.Nil(t, err)
+	defer clientConn.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	got, err := io.ReadAll(clientConn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(got))
+
+	assert.Error(t, <-serverReadErr)
+}
+
+// TestServerCloseHandlerRunning tests that a server close resets the stream when the handler
+// keeps running and does not wait on the context.
+func TestServerCloseHandlerRunning(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	defer close(release)
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverConn, err := Accept(w, r)
+		require.NoError(t, err)
+		_, err = serverConn.Write([]byte("hello"))
+		assert.NoError(t, err)
+		go serverConn.Close()
+		// Keep working without returning.
+		<-release
+	}))
+	defer server.Close()
+
+	clientConn, _, err := insecureClient.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	defer clientConn.Close()
+
+	start := time.Now()
+	got, err := io.ReadAll(clientConn)
+	assert.Error(t, err)
+	assert.Equal(t, "hello", string(got))
+	assert.True(t, time.Since(start) < time.Second, "took %v", time.Since(start))
+}
+
+// TestConnDone tests that Done is closed and Err reports the reason when the connection ends.
+func TestConnDone(t *testing.T) {
+	t.Parallel()
+
+	errCustom := errors.New("custom")
+
+	t.Run("local close", func(t *testing.T) {
+		t.Parallel()
+		server, serverAccepted, serverHandlerWait := startServer()
+		defer server.Close()
+		defer close(serverHandlerWait)
+
+		clientConn, _, err := insecureClient.Connect(context.Background(), server.URL)
+		require.NoError(t, err)
+		defer clientConn.Close()
+		serverConn := <-serverAccepted
+
+		assert.NoError(t, serverConn.Err())
+		assert.NoError(t, clientConn.Err())
+		require.NoError(t, serverConn.Close())
+		<-serverConn.Done()
+		assert.Equal(t, net.ErrClosed, serverConn.Err())
+		assert.Equal(t, net.ErrClosed, context.Cause(serverConn.Context()))
+	})
+
+	t.Run("peer EOF", func(t *testing.T) {
+		t.Parallel()
+		server := nopHandler(t)
+		defer server.Close()
+
+		clientConn, _, err := insecureClient.Connect(context.Background(), server.URL)
+		require.NoError(t, err)
+		defer clientConn.Close()
+
+		_, err = clientConn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+		<-clientConn.Done()
+		assert.Equal(t, io.EOF, clientConn.Err())
+	})
+
+	t.Run("peer close error", func(t *testing.T) {
+		t.Parallel()
+		serverErr := make(chan error, 1)
+		server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := Accept(w, r)
+			require.NoError(t, err)
+			defer conn.Close()
+			conn.Read(make([]byte, 1))
+			<-conn.Done()
+			serverErr <- conn.Err()
+		}))
+		defer server.Close()
+
+		clientConn, _, err := insecureClient.Connect(context.Background(), server.URL)
+		require.NoError(t, err)
+		require.NoError(t, clientConn.CloseWithError(3, "bye"))
+		assert.Equal(t, &CloseError{Code: 3, Reason: "bye"}, <-serverErr)
+	})
+
+	t.Run("context cancel", func(t *testing.T) {
+		t.Parallel()
+		serverErr := make(chan error, 1)
+		server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := Accept(w, r)
+			require.NoError(t, err)
+			<-conn.Done()
+			serverErr <- conn.Err()
+		}))
+		defer server.Close()
+
+		ctx, cancel := context.WithCancelCause(context.Background())
+		clientConn, _, err := insecureClient.Connect(ctx, server.URL)
+		require.NoError(t, err)
+		defer clientConn.Close()
+
+		cancel(errCustom)
+		<-clientConn.Done()
+		assert.Equal(t, errCustom, clientConn.Err())
+		assert.Equal(t, context.Canceled, <-serverErr)
+	})
+}
+
+// TestHalfClose tests closing the write side and the read side of the connection
+func TestHalfClose(t *testing.T) {
+	t.Parallel()
+
+	server, serverAccepted, serverHandlerWait := startServer()
+	defer server.Close()
+	defer close(serverHandlerWait)
+
+	clientConn, resp, err := insecureClient.Connect(context.Background(), server.URL)
+	require.Nil(t, err)
+	defer clientConn.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	serverConn := <-serverAccepted
+
+	// Client sends a request and closes the write side.
+	_, err = clientConn.Write([]byte("request"))
+	require.NoError(t, err)
+	require.NoError(t, clientConn.CloseWrite())
+	_, err = clientConn.Write([]byte("more"))
+	assert.Error(t, err)
+
+	// Server reads the request until EOF.
+	got, err := io.ReadAll(serverConn)
+	require.NoError(t, err)
+	assert.Equal(t, "request", string(got))
+
+	// Server closes the read side and can still respond.
+	require.NoError(t, serverConn.CloseRead())
+	_, err = serverConn.Read(make([]byte, 10))
+	assert.Error(t, err)
+	_, err = serverConn.Write([]byte("response"))
+	require.NoError(t, err)
+
+	buf := make([]byte, len("response"))
+	_, err = io.ReadFull(clientConn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "response", string(buf))
+
+	// The server can not end the response before the handler returns.
+	assert.Equal(t, errors.ErrUnsupported, serverConn.CloseWrite())
+	_, err = serverConn.Write([]byte("still open"))
+	assert.NoError(t, err)
+}
+
+// TestBufferWrites tests buffering of server writes
+func TestBufferWrites(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		server *Server
+		// flush is called after the data was written on the server.
+		flush func(*testing.T, *Conn)
+	}{
+		{
+			name:   "explicit flush",
+			server: &Server{BufferWrites: true},
+			flush: func(t *testing.T, conn *Conn) {
+				require.NoError(t, conn.Flush())
+			},
+		},
+		{
+			name:   "flush size",
+			server: &Server{BufferWrites: true, FlushSize: 10},
+			flush: func(t *testing.T, conn *Conn) {
+				_, err := conn.Write([]byte("world"))
+				require.NoError(t, err)
+			},
+		},
+		{
+			name:   "flush interval",
+			server: &Server{BufferWrites: true, FlushInterval: shortDuration},
+			flush:  func(*testing.T, *Conn) {},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			server, serverAccepted, serverHandlerWait := startCustomServer(tt.server)
+			defer server.Close()
+			defer close(serverHandlerWait)
+
+			clientConn, resp, err := insecureClient.Connect(context.Background(), server.URL)
+			require.NoError(t, err)
+			defer clientConn.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			serverConn := <-serverAccepted
+
+			_, err = serverConn.Write([]byte("hello"))
+			require.NoError(t, err)
+
+			// The data is buffered on the server.
+			buf := make([]byte, 5)
+			require.NoError(t, clientConn.SetReadDeadline(time.Now().Add(shortDuration/3)))
+			_, err = clientConn.Read(buf)
+			assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+			tt.flush(t, serverConn)
+
+			require.NoError(t, clientConn.SetReadDeadline(time.Now().Add(5*shortDuration)))
+			_, err = io.ReadFull(clientConn, buf)
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(buf))
+		})
+	}
+}
+
+// TestHTTP1 tests full duplex communication over HTTP1.1
+func TestHTTP1(t *testing.T) {
+	t.Parallel()
+
+	u := Server{AllowHTTP1: true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverConn, err := u.Accept(w, r)
+		require.NoError(t, err)
+		defer serverConn.Close()
+		assert.Equal(t, 1, r.ProtoMajor)
+
+		// Echo lines in upper case until the client closes the write side.
+		buf := bufio.NewReader(serverConn)
+		for {
+			msg, err := buf.ReadBytes('\n')
+			if err != nil {
+				assert.Equal(t, io.EOF, err)
+				return
+			}
+			_, err = serverConn.Write(bytes.ToUpper(msg))
+			require.NoError(t, err)
+		}
+	}))
+	defer server.Close()
+
+	cl := Client{AllowHTTP1: true}
+	clientConn, resp, err := cl.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	defer clientConn.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, resp.ProtoMajor)
+
+	buf := bufio.NewReader(clientConn)
+	for _, msg := range []string{"hello\n", "world\n"} {
+		_, err = clientConn.Write([]byte(msg))
+		require.NoError(t, err)
+		got, err := buf.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, strings.ToUpper(msg), got)
+	}
+
+	require.NoError(t, clientConn.CloseWrite())
+	_, err = buf.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
 func TestSpecialCases(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
@@ -188,6 +494,39 @@ func TestSpecialCases(t *testing.T) {
 				}))
 			},
 		},
+		{
+			name: "cleartext",
+			client: func() *Client {
+				return &Client{Cleartext: true}
+			},
+			server: func(*testing.T) *httptest.Server {
+				return h2test.NewUnencryptedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					_, err := Accept(w, r)
+					require.NoError(t, err)
+					assert.Equal(t, 2, r.ProtoMajor)
+				}))
+			},
+		},
+		{
+			name: "cleartext handler",
+			client: func() *Client {
+				return &Client{Cleartext: true}
+			},
+			server: func(*testing.T) *httptest.Server {
+				return httptest.NewServer(H2CHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					_, err := Accept(w, r)
+					require.NoError(t, err)
+				})))
+			},
+		},
+		{
+			name:   "cleartext client with TLS server",
+			server: nopHandler,
+			client: func() *Client {
+				return &Client{Cleartext: true}
+			},
+			wantErr: true,
+		},
 		{
 			name: "server use http1",
 			server: func(*testing.T) *httptest.Server {
@@ -300,19 +639,25 @@ func TestFormat(t *testing.T) {
 }
 
 func startServer() (server *httptest.Server, serverAccepted <-chan *Conn, serverHandlerWait chan<- struct{}) {
+	return startCustomServer(&defaultUpgrader)
+}
+
+func startCustomServer(u *Server) (server *httptest.Server, serverAccepted <-chan *Conn, serverHandlerWait chan<- struct{}) {
 	var (
 		accepted    = make(chan *Conn)
 		handlerWait = make(chan struct{})
 	)
 
 	server = h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		serverConn, err := Accept(w, r)
+		serverConn, err := u.Accept(w, r)
 		if err != nil {
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 		accepted <- serverConn
 		<-handlerWait
+		serverConn.Close()
+		<-r.Context().Done()
 	}))
 
 	return server, accepted, handlerWait
@@ -350,12 +695,12 @@ func (f *constLenFormatter) Decode(v interface{}) error {
 		return fmt.Errorf("works only for string pointers")
 	}
 	buf := make([]byte, f.len)
-	n, err := f.rw.Read(buf)
+	_, err := io.ReadFull(f.rw, buf)
 	if err != nil {
 		return err
 	}
 
-	*i = int(binary.LittleEndian.Uint64(buf[:n]))
+	*i = int(binary.LittleEndian.Uint64(buf))
 
 	return nil
 }
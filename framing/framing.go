@@ -0,0 +1,113 @@
+// Package framing provides message boundaries over a stream of bytes, such as an h2conn.Conn.
+//
+// A single write on one side of an HTTP2 connection is not guaranteed to be read by a single
+// read on the other side. A Framer prefixes each message with its varint encoded length, such
+// that every message that is written with WriteMessage is read whole by ReadMessage.
+package framing
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultMaxMessageSize is the maximal message size if a Framer has no MaxMessageSize set.
+const DefaultMaxMessageSize = 1 << 24
+
+// MessageTooLargeError is returned when a message exceeds the maximal message size.
+type MessageTooLargeError struct {
+	// Size is the size of the message.
+	Size uint64
+	// Max is the maximal allowed message size.
+	Max int
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("message size %d exceeds maximum of %d", e.Size, e.Max)
+}
+
+// Framer reads and writes length prefixed messages over a stream of bytes.
+// It is safe to call ReadMessage and WriteMessage concurrently.
+type Framer struct {
+	// MaxMessageSize is the maximal size of a message that can be read or written.
+	// A larger message is not written, and a *MessageTooLargeError is returned.
+	// A larger message is not read either: ReadMessage returns a *MessageTooLargeError, and
+	// keeps returning it, since the following messages can not be read without the message.
+	// The default, if not set, is DefaultMaxMessageSize.
+	MaxMessageSize int
+
+	r     *bufio.Reader
+	w     io.Writer
+	rLock sync.Mutex
+	wLock sync.Mutex
+	wBuf  []byte
+	// rErr is returned by all reads after a message that is too large.
+	rErr error
+}
+
+// NewFramer returns a Framer that reads and writes messages over rw.
+func NewFramer(rw io.ReadWriter) *Framer {
+	return &Framer{
+		r: bufio.NewReader(rw),
+		w: rw,
+	}
+}
+
+// WriteMessage writes a message.
+// The message is written with a single write to the underlying writer.
+func (f *Framer) WriteMessage(msg []byte) error {
+	if max := f.maxMessageSize(); len(msg) > max {
+		return &MessageTooLargeError{Size: uint64(len(msg)), Max: max}
+	}
+
+	f.wLock.Lock()
+	defer f.wLock.Unlock()
+
+	var header [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], uint64(len(msg)))
+	f.wBuf = append(append(f.wBuf[:0], header[:n]...), msg...)
+	_, err := f.w.Write(f.wBuf)
+	return err
+}
+
+// ReadMessage reads a message.
+// It returns io.EOF only if the underlying reader ended between messages.
+func (f *Framer) ReadMessage() ([]byte, error) {
+	f.rLock.Lock()
+	defer f.rLock.Unlock()
+	if f.rErr != nil {
+		return nil, f.rErr
+	}
+
+	size, err := binary.ReadUvarint(f.r)
+	if err != nil {
+		return nil, err
+	}
+	if max := f.maxMessageSize(); size > uint64(max) {
+		f.rErr = &MessageTooLargeError{Size: size, Max: max}
+		return nil, f.rErr
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(f.r, msg); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return msg, nil
+}
+
+func (f *Framer) maxMessageSize() int {
+	if f.MaxMessageSize > 0 {
+		return f.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+// unexpectedEOF converts an io.EOF in the middle of a message to io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
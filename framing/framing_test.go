@@ -0,0 +1,104 @@
+package framing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFramer(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	f := NewFramer(&buf)
+
+	msgs := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte("x"), 1000)}
+	for _, msg := range msgs {
+		require.NoError(t, f.WriteMessage(msg))
+	}
+
+	// Read the stream one byte at a time, to make sure that message boundaries are
+	// independent of the underlying reads.
+	r := NewFramer(struct {
+		io.Reader
+		io.Writer
+	}{Reader: &oneByteReader{r: &buf}})
+	for _, want := range msgs {
+		got, err := r.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := r.ReadMessage()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestFramerMaxMessageSize(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	f := NewFramer(&buf)
+	f.MaxMessageSize = 4
+
+	// Writing a large message fails.
+	err := f.WriteMessage([]byte("hello"))
+	var tooLarge *MessageTooLargeError
+	require.True(t, errors.As(err, &tooLarge))
+	assert.Equal(t, uint64(5), tooLarge.Size)
+	assert.Equal(t, 4, tooLarge.Max)
+
+	// Reading a large message fails, and the following reads fail with the same error, since
+	// the stream is not read beyond the header of the large message.
+	w := NewFramer(&buf)
+	require.NoError(t, w.WriteMessage([]byte("hello")))
+	require.NoError(t, w.WriteMessage([]byte("hi")))
+
+	_, err = f.ReadMessage()
+	assert.True(t, errors.As(err, &tooLarge))
+	_, err2 := f.ReadMessage()
+	assert.Equal(t, err, err2)
+}
+
+// TestFramerHugeSize tests that a size that does not fit in an int64 is rejected.
+func TestFramerHugeSize(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	buf.Write(binary.AppendUvarint(nil, math.MaxUint64))
+	buf.WriteString("payload")
+
+	f := NewFramer(&buf)
+	_, err := f.ReadMessage()
+	var tooLarge *MessageTooLargeError
+	require.True(t, errors.As(err, &tooLarge))
+	assert.Equal(t, uint64(math.MaxUint64), tooLarge.Size)
+	_, err = f.ReadMessage()
+	assert.True(t, errors.As(err, &tooLarge))
+}
+
+func TestFramerUnexpectedEOF(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	require.NoError(t, NewFramer(&buf).WriteMessage([]byte("hello")))
+	buf.Truncate(3)
+
+	_, err := NewFramer(&buf).ReadMessage()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return r.r.Read(p[:1])
+}
@@ -5,6 +5,7 @@ import (
 	"net/http/httptest"
 
 	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // NewServer starts a new HTTP2 writer for testing purposes.
@@ -33,3 +34,19 @@ func NewServer(h http.Handler) *httptest.Server {
 	server.StartTLS()
 	return server
 }
+
+// NewUnencryptedServer starts a new HTTP2 server over plain TCP (h2c) for testing purposes.
+// Clients should connect with prior knowledge of the HTTP2 support.
+//
+// Usage:
+// 		func TestMyHandler(t *testing.T) {
+//			h := MyHandler{}
+//			server := h2test.NewUnencryptedServer(h)
+// 			defer server.Close()
+//			// test stuff
+//			// ...
+//		}
+//
+func NewUnencryptedServer(h http.Handler) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(h, &http2.Server{}))
+}
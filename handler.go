@@ -0,0 +1,98 @@
+package h2conn
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// Handler returns an http.Handler that accepts connections and serves them with f, using the
+// default server configuration. See Server.Handler for more info.
+//
+// Usage:
+//
+//      http.Handle("/echo", h2conn.Handler(func(ctx context.Context, conn *h2conn.Conn) error {
+//          _, err := io.Copy(conn, conn)
+//          return err
+//      }))
+//
+func Handler(f func(ctx context.Context, conn *Conn) error) http.Handler {
+	return defaultUpgrader.Handler(f)
+}
+
+// Handler returns an http.Handler that accepts connections and serves them with f.
+//
+// Requests that can not be accepted are responded with http.StatusHTTPVersionNotSupported,
+// if the client does not support HTTP2, or with the rejection of the Authenticator or the
+// connection limits.
+// The context that is given to f is the connection context.
+//
+// The connection is closed when f returns. If it returns an error, the connection is closed
+// with it as the close reason: a *CloseError is sent as is, and other errors are sent with
+// the CloseInternalError code. If f panics, the panic is logged and the connection is closed
+// with the CloseInternalError code. If f returns nil after the server started shutting down,
+// the connection is closed with the CloseGoingAway code.
+func (u *Server) Handler(f func(ctx context.Context, conn *Conn) error) http.Handler {
+	return &handler{server: u, f: f}
+}
+
+type handler struct {
+	server *Server
+	f      func(ctx context.Context, conn *Conn) error
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.server.Accept(w, r)
+	if err != nil {
+		switch {
+		case responded(err):
+		case err == ErrHTTP2NotSupported:
+			// Respond without draining the HTTP1.1 request body, which the client might
+			// still be sending.
+			http.NewResponseController(w).EnableFullDuplex()
+			http.Error(w, http.StatusText(http.StatusHTTPVersionNotSupported), http.StatusHTTPVersionNotSupported)
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = h.serve(r, conn)
+	var closeErr *CloseError
+	switch {
+	case err == nil && isClosedChan(conn.goingAway):
+		conn.CloseWithError(CloseGoingAway, "server shutting down")
+	case err == nil:
+		conn.Close()
+	case errors.As(err, &closeErr):
+		conn.CloseWithError(closeErr.Code, closeErr.Reason)
+	default:
+		conn.CloseWithError(CloseInternalError, err.Error())
+	}
+
+	// The response writer must not be used after the handler returns, the connection context
+	// is done after pending writes are done.
+	<-conn.Done()
+}
+
+// serve calls the function, and converts a panic to an error.
+func (h *handler) serve(r *http.Request, conn *Conn) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			logf(r, "h2conn: panic serving %v: %v\n%s", r.RemoteAddr, p, debug.Stack())
+			err = &CloseError{Code: CloseInternalError, Reason: "internal error"}
+		}
+	}()
+	return h.f(conn.Context(), conn)
+}
+
+// logf logs with the error logger of the http server, or with the standard logger.
+func logf(r *http.Request, format string, args ...interface{}) {
+	if s, ok := r.Context().Value(http.ServerContextKey).(*http.Server); ok && s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
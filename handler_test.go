@@ -0,0 +1,104 @@
+package h2conn
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/posener/h2conn/h2test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		f       func(ctx context.Context, conn *Conn) error
+		input   string
+		want    string
+		wantErr error
+	}{
+		{
+			name: "echo",
+			f: func(ctx context.Context, conn *Conn) error {
+				_, err := io.Copy(conn, conn)
+				return err
+			},
+			input: "hello",
+			want:  "hello",
+		},
+		{
+			name: "error",
+			f: func(ctx context.Context, conn *Conn) error {
+				conn.Write([]byte("hello"))
+				return errors.New("failed")
+			},
+			want:    "hello",
+			wantErr: &CloseError{Code: CloseInternalError, Reason: "failed"},
+		},
+		{
+			name: "close error",
+			f: func(ctx context.Context, conn *Conn) error {
+				return &CloseError{Code: 7, Reason: "kicked"}
+			},
+			wantErr: &CloseError{Code: 7, Reason: "kicked"},
+		},
+		{
+			name: "panic",
+			f: func(ctx context.Context, conn *Conn) error {
+				panic("boom")
+			},
+			wantErr: &CloseError{Code: CloseInternalError, Reason: "internal error"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := h2test.NewServer(Handler(tt.f))
+			defer server.Close()
+
+			conn, resp, err := insecureClient.Connect(context.Background(), server.URL)
+			require.NoError(t, err)
+			defer conn.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			if tt.input != "" {
+				_, err = conn.Write([]byte(tt.input))
+				require.NoError(t, err)
+				require.NoError(t, conn.CloseWrite())
+			}
+
+			got, err := io.ReadAll(conn)
+			assert.Equal(t, tt.want, string(got))
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.Equal(t, tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestHandlerHTTP1 tests that HTTP1.1 requests are responded with an error status code.
+func TestHandlerHTTP1(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(Handler(func(ctx context.Context, conn *Conn) error {
+		t.Error("unexpected connection")
+		return nil
+	}))
+	defer server.Close()
+
+	conn, resp, err := (&Client{AllowHTTP1: true}).Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, http.StatusHTTPVersionNotSupported, resp.StatusCode)
+}
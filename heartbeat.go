@@ -0,0 +1,354 @@
+package h2conn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrPeerUnresponsive is returned by connection operations after the connection was closed
+// because nothing was received from the other side within the heartbeat timeout.
+var ErrPeerUnresponsive = errors.New("peer unresponsive")
+
+// heartbeatHeader is the header in which each side sends its heartbeat timeout, when
+// heartbeats are enabled.
+const heartbeatHeader = "H2conn-Heartbeat"
+
+// Heartbeat frame types. When heartbeats are enabled, data is sent in frames, such that
+// heartbeats can be sent in-band between them.
+const (
+	frameData byte = iota
+	frameHeartbeat
+)
+
+// maxDataFrame is the maximal size of a data frame. Writes are split to frames, such that the
+// progress of a large write can be tracked.
+const maxDataFrame = 16 << 10
+
+// heartbeatTimeout returns the heartbeat timeout for the given configuration.
+func heartbeatTimeout(interval, timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	return 3 * interval
+}
+
+// parseHeartbeat returns the heartbeat timeout of the other side from its header, and false
+// if it did not enable heartbeats.
+func parseHeartbeat(h http.Header) (time.Duration, bool) {
+	d, err := time.ParseDuration(h.Get(heartbeatHeader))
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// enableHeartbeat enables in-band heartbeats on the connection. A heartbeat is sent when
+// nothing was written for the interval, which is shortened according to the timeout of the
+// other side. The connection is closed with ErrPeerUnresponsive if nothing is received for
+// the timeout. Received data that was not read blocks the heartbeats of the other side, and
+// then only a write that makes no progress for the timeout closes the connection.
+// It should be called before the connection is used.
+func (c *Conn) enableHeartbeat(interval, timeout, peerTimeout time.Duration) {
+	if max := peerTimeout / 3; interval > max {
+		interval = max
+	}
+	hr := newHeartbeatReader(c.r)
+	hw := &heartbeatWriter{wc: c.wc, lastWrite: time.Now()}
+	c.r, c.wc = hr, hw
+	go c.heartbeat(hr, hw, interval, timeout)
+}
+
+// heartbeat sends heartbeats and checks that the other side is responsive.
+func (c *Conn) heartbeat(hr *heartbeatReader, hw *heartbeatWriter, interval, timeout time.Duration) {
+	tick := interval
+	if timeout/2 < tick {
+		tick = timeout / 2
+	}
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-t.C:
+		}
+		// A write that made no progress is caused by a slow reader on the other side, unless
+		// nothing, not even a heartbeat, was received from it.
+		if hr.idle() > timeout || (hw.stalled() > timeout && hr.silent() > timeout) {
+			c.closeWithCause(ErrPeerUnresponsive, nil)
+			return
+		}
+		if hw.idle() >= interval {
+			c.sendHeartbeat(hw)
+		}
+	}
+}
+
+// sendHeartbeat sends a heartbeat in the background, unless a write is in progress.
+func (c *Conn) sendHeartbeat(hw *heartbeatWriter) {
+	// A write holds the lock while it waits, possibly for a write that is blocked by flow
+	// control, which a heartbeat can not pass either.
+	if !c.wLock.TryLock() {
+		return
+	}
+	defer c.wLock.Unlock()
+	if isClosedChan(c.closed) {
+		return
+	}
+	if c.wPending {
+		// Collect a completed write, such as a previous heartbeat, which nothing waits for.
+		select {
+		case err := <-c.wDone:
+			c.wPending = false
+			if err != nil && c.wErr == nil {
+				c.wErr = err
+			}
+		default:
+			return
+		}
+	}
+	c.startWrite(hw.writeHeartbeat)
+}
+
+// heartbeatReader reads data frames, and skips heartbeats.
+// Frames are read in the background, such that heartbeats are received also when nothing
+// reads the connection. Up to maxDataFrame bytes of data are buffered, after which the other
+// side is blocked by flow control.
+type heartbeatReader struct {
+	r  io.ReadCloser
+	br *bufio.Reader
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	err  error
+	// full is set while the background reader waits for the buffered data to be read.
+	full     bool
+	lastRecv time.Time
+}
+
+func newHeartbeatReader(r io.ReadCloser) *heartbeatReader {
+	h := &heartbeatReader{r: r, br: bufio.NewReader(r), lastRecv: time.Now()}
+	h.cond = sync.NewCond(&h.mu)
+	go h.readFrames()
+	return h
+}
+
+func (h *heartbeatReader) Read(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for h.buf.Len() == 0 && h.err == nil {
+		h.cond.Wait()
+	}
+	if h.buf.Len() == 0 {
+		return 0, h.err
+	}
+	n, _ := h.buf.Read(p)
+	h.cond.Broadcast()
+	return n, nil
+}
+
+func (h *heartbeatReader) Close() error {
+	h.fail(net.ErrClosed)
+	return h.r.Close()
+}
+
+// readFrames reads frames until the connection fails or is closed.
+func (h *heartbeatReader) readFrames() {
+	chunk := make([]byte, maxDataFrame)
+	for {
+		typ, err := h.br.ReadByte()
+		if err != nil {
+			h.fail(err)
+			return
+		}
+		h.received(nil)
+		switch typ {
+		case frameHeartbeat:
+			continue
+		case frameData:
+		default:
+			h.fail(fmt.Errorf("invalid frame type %d", typ))
+			return
+		}
+
+		remaining, err := binary.ReadUvarint(h.br)
+		if err != nil {
+			h.fail(unexpectedEOF(err))
+			return
+		}
+		for remaining > 0 {
+			if !h.waitSpace() {
+				return
+			}
+			n := chunk
+			if uint64(len(n)) > remaining {
+				n = n[:remaining]
+			}
+			m, err := h.br.Read(n)
+			remaining -= uint64(m)
+			h.received(n[:m])
+			if err != nil {
+				h.fail(unexpectedEOF(err))
+				return
+			}
+		}
+	}
+}
+
+// waitSpace waits until the buffered data is read, and returns false if the reader failed.
+func (h *heartbeatReader) waitSpace() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for h.buf.Len() >= maxDataFrame && h.err == nil {
+		h.full = true
+		h.cond.Wait()
+	}
+	h.full = false
+	return h.err == nil
+}
+
+// received buffers received data, and marks that something was received.
+func (h *heartbeatReader) received(data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Write(data)
+	h.lastRecv = time.Now()
+	h.cond.Broadcast()
+}
+
+func (h *heartbeatReader) fail(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.err == nil {
+		h.err = err
+	}
+	h.cond.Broadcast()
+}
+
+// idle returns the time in which nothing was received. Time in which the buffer is full is not
+// counted as idle time, since the other side might be blocked by flow control.
+func (h *heartbeatReader) idle() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.full {
+		return 0
+	}
+	return time.Since(h.lastRecv)
+}
+
+// silent returns the time in which nothing was received, including time in which the buffer
+// is full.
+func (h *heartbeatReader) silent() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Since(h.lastRecv)
+}
+
+// heartbeatWriter writes data frames and heartbeats.
+type heartbeatWriter struct {
+	wc  io.WriteCloser
+	buf []byte
+
+	mu sync.Mutex
+	// writing is the number of writes and flushes to wc that are in progress.
+	writing int
+	// lastWrite is the time in which the last write or flush to wc started or ended.
+	lastWrite time.Time
+}
+
+func (h *heartbeatWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := len(p) - written
+		if n > maxDataFrame {
+			n = maxDataFrame
+		}
+		h.buf = append(h.buf[:0], frameData)
+		h.buf = binary.AppendUvarint(h.buf, uint64(n))
+		h.buf = append(h.buf, p[written:written+n]...)
+		if _, err := h.write(h.buf); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// writeHeartbeat writes a heartbeat, and flushes it.
+// Errors are ignored, since the write side might be closed while the other side still reads,
+// and a broken connection is detected by the other side.
+func (h *heartbeatWriter) writeHeartbeat() error {
+	if _, err := h.write([]byte{frameHeartbeat}); err == nil {
+		h.Flush()
+	}
+	return nil
+}
+
+func (h *heartbeatWriter) Flush() error {
+	f, ok := h.wc.(flusher)
+	if !ok {
+		return nil
+	}
+	h.start()
+	defer h.stop()
+	return f.Flush()
+}
+
+// write writes to wc, and tracks its progress.
+func (h *heartbeatWriter) write(b []byte) (int, error) {
+	h.start()
+	defer h.stop()
+	return h.wc.Write(b)
+}
+
+func (h *heartbeatWriter) Close() error {
+	return h.wc.Close()
+}
+
+func (h *heartbeatWriter) start() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writing++
+	h.lastWrite = time.Now()
+}
+
+func (h *heartbeatWriter) stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writing--
+	h.lastWrite = time.Now()
+}
+
+// stalled returns the time in which a write is in progress and made no progress.
+func (h *heartbeatWriter) stalled() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.writing == 0 {
+		return 0
+	}
+	return time.Since(h.lastWrite)
+}
+
+// idle returns the time since the last write.
+func (h *heartbeatWriter) idle() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Since(h.lastWrite)
+}
+
+// unexpectedEOF converts an io.EOF in the middle of a frame to io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,198 @@
+package h2conn
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/posener/h2conn/h2test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const heartbeatInterval = 20 * time.Millisecond
+
+// TestHeartbeat tests that an idle connection with heartbeats stays open.
+func TestHeartbeat(t *testing.T) {
+	t.Parallel()
+
+	u := Server{HeartbeatInterval: heartbeatInterval}
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := u.Accept(w, r)
+		require.NoError(t, err)
+
+		// Stay idle for several heartbeat timeouts, then echo.
+		time.Sleep(10 * heartbeatInterval)
+		_, err = io.Copy(conn, conn)
+		assert.NoError(t, err)
+		conn.Close()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	cl := insecureClient
+	cl.HeartbeatInterval = heartbeatInterval
+	conn, resp, err := cl.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "60ms", resp.Header.Get(heartbeatHeader))
+
+	buf := make([]byte, 5)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	require.NoError(t, conn.CloseWrite())
+	_, err = conn.Read(buf)
+	assert.Equal(t, io.EOF, err)
+}
+
+// TestHeartbeatServerDetectsClient tests that the server closes the connection of a client
+// that stopped sending heartbeats.
+func TestHeartbeatServerDetectsClient(t *testing.T) {
+	t.Parallel()
+
+	serverErr := make(chan error, 1)
+	u := Server{HeartbeatInterval: heartbeatInterval}
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := u.Accept(w, r)
+		require.NoError(t, err)
+		_, err = conn.Read(make([]byte, 1))
+		serverErr <- err
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	// The client asks for heartbeats, but does not send them.
+	cl := insecureClient
+	cl.Header = http.Header{heartbeatHeader: []string{"1s"}}
+	conn, _, err := cl.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, ErrPeerUnresponsive, <-serverErr)
+}
+
+// TestHeartbeatClientDetectsServer tests that the client closes the connection of a server
+// that stopped sending heartbeats.
+func TestHeartbeatClientDetectsServer(t *testing.T) {
+	t.Parallel()
+
+	handlerDone := make(chan struct{})
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server accepts heartbeats, but does not send them.
+		w.Header().Set(heartbeatHeader, "1s")
+		_, err := Accept(w, r)
+		require.NoError(t, err)
+		<-handlerDone
+	}))
+	defer server.Close()
+	defer close(handlerDone)
+
+	cl := insecureClient
+	cl.HeartbeatInterval = heartbeatInterval
+	conn, _, err := cl.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, ErrPeerUnresponsive, err)
+	_, err = conn.Write([]byte("hello"))
+	assert.Equal(t, ErrPeerUnresponsive, err)
+}
+
+// TestHeartbeatNotSupported tests that a connection is used without heartbeats if only one
+// side enables them.
+func TestHeartbeatNotSupported(t *testing.T) {
+	t.Parallel()
+
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Accept(w, r)
+		require.NoError(t, err)
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}))
+	defer server.Close()
+
+	cl := insecureClient
+	cl.HeartbeatInterval = heartbeatInterval
+	conn, resp, err := cl.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "", resp.Header.Get(heartbeatHeader))
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+// TestHeartbeatWriteStalled tests that the server closes the connection of a client that stopped,
+// while the server writes and data that the server did not read blocks the client heartbeats.
+func TestHeartbeatWriteStalled(t *testing.T) {
+	t.Parallel()
+
+	serverErr := make(chan error, 1)
+	u := Server{HeartbeatInterval: heartbeatInterval}
+	server := h2test.NewServer(u.Handler(func(ctx context.Context, conn *Conn) error {
+		data := make([]byte, 64<<10)
+		for {
+			if _, err := conn.Write(data); err != nil {
+				serverErr <- err
+				return err
+			}
+		}
+	}))
+	defer server.Close()
+
+	// The client asks for heartbeats, but does not send them. It writes a data frame that
+	// the server does not read, and does not read.
+	cl := insecureClient
+	cl.Header = http.Header{heartbeatHeader: []string{"1s"}}
+	conn, _, err := cl.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+	frame := binary.AppendUvarint([]byte{frameData}, 1<<20)
+	go conn.Write(append(frame, make([]byte, 1<<20)...))
+
+	select {
+	case err := <-serverErr:
+		assert.Equal(t, ErrPeerUnresponsive, err)
+	case <-time.After(time.Second):
+		t.Fatal("stalled write was not detected")
+	}
+}
+
+// TestHeartbeatSlowReader tests that a connection to a client that reads slowly survives while
+// the server writes are blocked by flow control.
+func TestHeartbeatSlowReader(t *testing.T) {
+	t.Parallel()
+
+	const size = 6400 << 10
+	u := Server{HeartbeatInterval: 100 * time.Millisecond}
+	server := h2test.NewServer(u.Handler(func(ctx context.Context, conn *Conn) error {
+		_, err := conn.Write(make([]byte, size))
+		assert.NoError(t, err)
+		return err
+	}))
+	defer server.Close()
+
+	cl := insecureClient
+	cl.HeartbeatInterval = 100 * time.Millisecond
+	conn, _, err := cl.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Start reading after several heartbeat timeouts.
+	time.Sleep(time.Second)
+	n, err := io.Copy(io.Discard, conn)
+	require.NoError(t, err)
+	assert.Equal(t, int64(size), n)
+}
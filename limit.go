@@ -0,0 +1,46 @@
+package h2conn
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// LimitError is returned by Accept when a connection was rejected by the connection limits of
+// the Server. The rejection response was already written, and the handler should not write to
+// it.
+type LimitError struct {
+	// Limit is the name of the Server field that rejected the connection: "MaxConns",
+	// "MaxConnsPerRemote" or "Admit".
+	Limit string
+	// StatusCode is the status code of the rejection response.
+	StatusCode int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("connection rejected by %s", e.Limit)
+}
+
+// reject responds to a request that was rejected by the connection limits, and returns the
+// error.
+func (u *Server) reject(w http.ResponseWriter, e *LimitError) error {
+	retryAfter := u.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = time.Second
+	}
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, http.StatusText(e.StatusCode), e.StatusCode)
+	return e
+}
+
+// remoteHost returns the host of a remote address.
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
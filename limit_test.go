@@ -0,0 +1,104 @@
+package h2conn
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/posener/h2conn/h2test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimits(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name           string
+		server         *Server
+		wantStatus     int
+		wantRetryAfter string
+		wantLimit      string
+	}{
+		{
+			name:           "max conns",
+			server:         &Server{MaxConns: 1},
+			wantStatus:     http.StatusServiceUnavailable,
+			wantRetryAfter: "1",
+			wantLimit:      "MaxConns",
+		},
+		{
+			name:           "max conns per remote",
+			server:         &Server{MaxConnsPerRemote: 1, RetryAfter: 1500 * time.Millisecond},
+			wantStatus:     http.StatusTooManyRequests,
+			wantRetryAfter: "2",
+			wantLimit:      "MaxConnsPerRemote",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			limitErr := make(chan error, 1)
+			server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := tt.server.Accept(w, r)
+				if err != nil {
+					limitErr <- err
+					return
+				}
+				conn.Read(make([]byte, 1))
+				conn.Close()
+				<-r.Context().Done()
+			}))
+			defer server.Close()
+
+			conn1, resp, err := insecureClient.Connect(context.Background(), server.URL)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			conn2, resp, err := insecureClient.Connect(context.Background(), server.URL)
+			require.NoError(t, err)
+			defer conn2.Close()
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			assert.Equal(t, tt.wantRetryAfter, resp.Header.Get("Retry-After"))
+			var e *LimitError
+			require.True(t, errors.As(<-limitErr, &e))
+			assert.Equal(t, tt.wantLimit, e.Limit)
+
+			// After the first connection ends, a new connection is accepted.
+			require.NoError(t, conn1.Close())
+			for len(tt.server.Conns()) > 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+			conn3, resp, err := insecureClient.Connect(context.Background(), server.URL)
+			require.NoError(t, err)
+			defer conn3.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	t.Parallel()
+
+	u := &Server{Admit: func(r *http.Request) bool { return r.Header.Get("Token") == "ok" }}
+	server := h2test.NewServer(u.Handler(func(ctx context.Context, conn *Conn) error { return nil }))
+	defer server.Close()
+
+	cl := insecureClient
+	cl.Header = http.Header{"Token": []string{"ok"}}
+	conn, resp, err := cl.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	conn, resp, err = insecureClient.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+}
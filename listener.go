@@ -0,0 +1,96 @@
+package h2conn
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Listener is an http.Handler and a net.Listener.
+// Every request that it handles is accepted as a full duplex connection, which is returned
+// by the Accept method. It enables serving TCP oriented servers, such as net/rpc, over
+// HTTP2 streams.
+//
+// The http handler blocks until the returned connection is closed, or the client is gone.
+// The returned connections are of type *Conn, and can be used to get the request header.
+//
+// Usage:
+//
+//      l := h2conn.NewListener(nil)
+//      go rpc.Accept(l)
+//      http.ListenAndServeTLS(":8443", "cert.pem", "key.pem", l)
+//
+type Listener struct {
+	server    *Server
+	conns     chan *Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewListener returns a listener that accepts connections with the given server.
+// If server is nil, the connections are accepted with the default server configuration.
+func NewListener(server *Server) *Listener {
+	if server == nil {
+		server = &defaultUpgrader
+	}
+	return &Listener{
+		server: server,
+		conns:  make(chan *Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// ServeHTTP accepts the request as a connection, and waits until it is closed.
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isClosedChan(l.closed) {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := l.server.Accept(w, r)
+	if err != nil {
+		if !responded(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	ctx := r.Context()
+
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	case <-ctx.Done():
+	}
+
+	// The request context is done after the connection is closed, and the response writer
+	// is no longer used.
+	<-ctx.Done()
+}
+
+// Accept waits for and returns the next connection.
+// It returns net.ErrClosed after the listener is closed.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener.
+// Requests that are handled after the listener is closed are rejected. Connections that were
+// already accepted are not closed.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+// Addr returns the listener's network address.
+// The listener is served by an HTTP server, so the returned address is a placeholder.
+func (l *Listener) Addr() net.Addr {
+	return addr("h2conn")
+}
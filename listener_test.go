@@ -0,0 +1,160 @@
+package h2conn
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/posener/h2conn/h2test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Upper is an RPC service that is used for testing, it must be exported.
+type Upper struct{}
+
+func (Upper) Upper(s string, reply *string) error {
+	*reply = strings.ToUpper(s)
+	return nil
+}
+
+// TestListener tests serving net/rpc over a listener.
+func TestListener(t *testing.T) {
+	t.Parallel()
+
+	l := NewListener(nil)
+	server := h2test.NewServer(l)
+	defer server.Close()
+	defer l.Close()
+
+	rpcServer := rpc.NewServer()
+	require.NoError(t, rpcServer.Register(Upper{}))
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		accepted <- conn
+		rpcServer.ServeConn(conn)
+	}()
+
+	cl := insecureClient
+	cl.Header = http.Header{"Foo": []string{"bar"}}
+	clientConn, resp, err := cl.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	serverConn := <-accepted
+	assert.Equal(t, "bar", serverConn.(*Conn).Header().Get("Foo"))
+	assert.Equal(t, clientConn.LocalAddr().String(), serverConn.RemoteAddr().String())
+
+	client := rpc.NewClient(clientConn)
+	defer client.Close()
+	for _, s := range []string{"hello", "world"} {
+		var reply string
+		require.NoError(t, client.Call("Upper.Upper", s, &reply))
+		assert.Equal(t, strings.ToUpper(s), reply)
+	}
+}
+
+// TestListenerClose tests that a closed listener does not accept connections.
+func TestListenerClose(t *testing.T) {
+	t.Parallel()
+
+	l := NewListener(nil)
+	server := h2test.NewServer(l)
+	defer server.Close()
+
+	require.NoError(t, l.Close())
+	_, err := l.Accept()
+	assert.True(t, errors.Is(err, net.ErrClosed))
+
+	_, resp, err := insecureClient.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+// TestListenerDialContext tests an HTTP server that is served over a listener, with a client
+// that dials it with DialContext.
+func TestListenerDialContext(t *testing.T) {
+	t.Parallel()
+
+	l := NewListener(nil)
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/tunnel/tcp/backend/80", r.URL.Path)
+		l.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	})}
+	go backend.Serve(l)
+	defer backend.Close()
+
+	cl := insecureClient
+	cl.URLTemplate = server.URL + "/tunnel/{network}/{host}/{port}"
+	httpClient := &http.Client{Transport: &http.Transport{DialContext: cl.DialContext}}
+	defer httpClient.CloseIdleConnections()
+
+	for _, path := range []string{"/foo", "/bar"} {
+		resp, err := httpClient.Get("http://backend" + path)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "hello "+path, string(body))
+	}
+}
+
+// TestDialURL tests the mapping of dialed addresses to URLs.
+func TestDialURL(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		tmpl, address, want string
+	}{
+		{tmpl: "", address: "backend:80", want: "https://backend:80"},
+		{tmpl: "", address: "[::1]:22", want: "https://[::1]:22"},
+		{tmpl: "https://{host}:8443/x", address: "backend:80", want: "https://backend:8443/x"},
+		{tmpl: "https://edge/tunnel/{addr}", address: "backend:80", want: "https://edge/tunnel/backend:80"},
+		{tmpl: "https://edge/tunnel/{addr}", address: "[::1]:22", want: "https://edge/tunnel/%5B::1%5D:22"},
+		{tmpl: "https://edge/tunnel/{host}/{port}", address: "[fe80::1%eth0]:22", want: "https://edge/tunnel/fe80::1%25eth0/22"},
+	}
+
+	for _, tt := range tests {
+		cl := Client{URLTemplate: tt.tmpl}
+		got, err := cl.dialURL("tcp", tt.address)
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, got)
+
+		// The dialed address is a single path segment.
+		u, err := url.Parse(got)
+		require.NoError(t, err)
+		if strings.Contains(tt.tmpl, "/tunnel/{addr}") {
+			assert.Equal(t, "/tunnel/"+tt.address, u.Path)
+		}
+	}
+}
+
+// TestDialContextBadStatus tests that dial fails when the server does not accept the connection.
+func TestDialContextBadStatus(t *testing.T) {
+	t.Parallel()
+
+	server := h2test.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	cl := insecureClient
+	cl.URLTemplate = server.URL + "/{addr}"
+	_, err := cl.DialContext(context.Background(), "tcp", "backend:80")
+	assert.Error(t, err)
+
+	_, err = cl.DialContext(context.Background(), "tcp", "missing-port")
+	assert.Error(t, err)
+}
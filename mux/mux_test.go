@@ -0,0 +1,194 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/posener/h2conn"
+	"github.com/posener/h2conn/h2test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/nettest"
+)
+
+// makeSessions returns client and server sessions over a pipe.
+func makeSessions(config *Config) (client, server *Session) {
+	c1, c2 := net.Pipe()
+	return Client(c1, config), Server(c2, config)
+}
+
+// TestStreamConn tests that a stream implements the net.Conn interface.
+func TestStreamConn(t *testing.T) {
+	nettest.TestConn(t, func() (c1, c2 net.Conn, stop func(), err error) {
+		client, server := makeSessions(nil)
+		s1, err := client.OpenStream()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		s2, err := server.AcceptStream()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		stop = func() {
+			s1.Close()
+			s2.Close()
+			client.Close()
+			server.Close()
+		}
+		return s1, s2, stop, nil
+	})
+}
+
+// TestMux tests streams that are opened by both sides over an h2conn connection.
+func TestMux(t *testing.T) {
+	t.Parallel()
+
+	const numStreams = 10
+
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := h2conn.Accept(w, r)
+		require.NoError(t, err)
+		session := Server(conn, nil)
+		defer session.Close()
+
+		// Open a stream toward the client.
+		stream, err := session.OpenStream()
+		require.NoError(t, err)
+		_, err = stream.Write([]byte("hello from server"))
+		require.NoError(t, err)
+		require.NoError(t, stream.Close())
+
+		// Echo the streams that are opened by the client.
+		var wg sync.WaitGroup
+		wg.Add(numStreams)
+		for i := 0; i < numStreams; i++ {
+			stream, err := session.AcceptStream()
+			require.NoError(t, err)
+			go func() {
+				defer wg.Done()
+				defer stream.Close()
+				_, err := io.Copy(stream, stream)
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+	}))
+	defer server.Close()
+
+	cl := h2conn.Client{Client: &http.Client{
+		Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}}
+	conn, resp, err := cl.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	session := Client(conn, nil)
+	defer session.Close()
+
+	stream, err := session.AcceptStream()
+	require.NoError(t, err)
+	got, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	assert.Equal(t, "hello from server", string(got))
+	stream.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(numStreams)
+	for i := 0; i < numStreams; i++ {
+		i := i
+		go func() {
+			defer wg.Done()
+			stream, err := session.OpenStream()
+			require.NoError(t, err)
+			defer stream.Close()
+
+			want := bytes.Repeat([]byte(fmt.Sprintf("stream %d\n", i)), 10000)
+			go func() {
+				_, err := stream.Write(want)
+				assert.NoError(t, err)
+				assert.NoError(t, stream.CloseWrite())
+			}()
+			got, err := io.ReadAll(stream)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		}()
+	}
+	wg.Wait()
+}
+
+// TestFlowControl tests that a stream that is not read does not block other streams.
+func TestFlowControl(t *testing.T) {
+	t.Parallel()
+
+	client, server := makeSessions(&Config{Window: 1024})
+	defer client.Close()
+	defer server.Close()
+
+	blocked, err := client.OpenStream()
+	require.NoError(t, err)
+	blockedServer, err := server.AcceptStream()
+	require.NoError(t, err)
+
+	want := bytes.Repeat([]byte("x"), 10*1024)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		_, err := blocked.Write(want)
+		assert.NoError(t, err)
+		assert.NoError(t, blocked.CloseWrite())
+	}()
+
+	other, err := client.OpenStream()
+	require.NoError(t, err)
+	otherServer, err := server.AcceptStream()
+	require.NoError(t, err)
+	_, err = other.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(otherServer, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	select {
+	case <-written:
+		t.Fatal("write should be blocked by the flow control window")
+	default:
+	}
+
+	got, err := io.ReadAll(blockedServer)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	<-written
+}
+
+// TestSessionClose tests that closing a session unblocks the streams.
+func TestSessionClose(t *testing.T) {
+	t.Parallel()
+
+	client, server := makeSessions(nil)
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	require.NoError(t, err)
+	remote, err := server.AcceptStream()
+	require.NoError(t, err)
+
+	require.NoError(t, client.Close())
+	_, err = stream.Read(make([]byte, 1))
+	assert.Equal(t, ErrSessionClosed, err)
+	_, err = client.OpenStream()
+	assert.Equal(t, ErrSessionClosed, err)
+
+	<-server.Done()
+	_, err = remote.Read(make([]byte, 1))
+	assert.Equal(t, ErrSessionClosed, err)
+	_, err = server.AcceptStream()
+	assert.Equal(t, ErrSessionClosed, err)
+}
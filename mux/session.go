@@ -0,0 +1,362 @@
+// Package mux multiplexes many logical streams over a single connection, such as an h2conn.Conn.
+//
+// Both sides of a Session can open streams with OpenStream, which are accepted by the other
+// side with AcceptStream. This enables the server side of an h2conn connection to open
+// streams toward the client. Each stream implements the net.Conn interface, and has its own
+// flow control window, such that a stream that is not read does not block the other streams.
+//
+// Usage:
+//
+//      // Client side
+//      session := mux.Client(conn, nil)
+//      stream, err := session.OpenStream()
+//
+//      // Server side
+//      session := mux.Server(conn, nil)
+//      stream, err := session.AcceptStream()
+//
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+var (
+	// ErrSessionClosed is returned when the session was closed.
+	ErrSessionClosed = errors.New("mux: session closed")
+	// ErrStreamReset is returned when the stream was reset by the other side.
+	ErrStreamReset = errors.New("mux: stream reset")
+)
+
+const (
+	// DefaultWindow is the flow control window of a stream if the Config has no Window set.
+	DefaultWindow = 256 * 1024
+	// DefaultAcceptBacklog is the accept backlog if the Config has no AcceptBacklog set.
+	DefaultAcceptBacklog = 256
+
+	// maxFrameSize is the maximal size of the payload of a data frame.
+	maxFrameSize = 16 * 1024
+)
+
+// Config configures a Session.
+// Both sides of a session should use the same Window.
+type Config struct {
+	// Window is the flow control window of each stream, in bytes. It is the amount of data
+	// that can be sent on a stream before it is read by the other side.
+	// The default, if not set, is DefaultWindow.
+	Window uint32
+	// AcceptBacklog is the number of streams that were opened by the other side and wait
+	// to be accepted. Streams that are opened when the backlog is full are reset.
+	// The default, if not set, is DefaultAcceptBacklog.
+	AcceptBacklog int
+}
+
+// Frame types.
+const (
+	typeData uint8 = iota
+	typeWindowUpdate
+)
+
+// Frame flags.
+const (
+	// flagSYN opens a stream.
+	flagSYN uint8 = 1 << iota
+	// flagFIN closes the write side of a stream.
+	flagFIN
+	// flagRST resets a stream.
+	flagRST
+)
+
+// headerSize is the size of a frame header: type (1), flags (1), stream ID (4) and length (4).
+// The length is the payload size for a data frame, and the window increment for a window
+// update frame.
+const headerSize = 10
+
+// Session multiplexes streams over a connection.
+// A session implements the net.Listener interface, where Accept accepts streams that are
+// opened by the other side.
+type Session struct {
+	conn   io.ReadWriteCloser
+	window uint32
+	client bool
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+
+	accept chan *Stream
+
+	wLock sync.Mutex
+	wBuf  []byte
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// Client starts a session on the client side of a connection.
+// If config is nil, the default configuration is used.
+func Client(conn io.ReadWriteCloser, config *Config) *Session {
+	return newSession(conn, config, 1)
+}
+
+// Server starts a session on the server side of a connection.
+// If config is nil, the default configuration is used.
+func Server(conn io.ReadWriteCloser, config *Config) *Session {
+	return newSession(conn, config, 2)
+}
+
+// newSession starts a session. Streams that are opened by the client side have odd IDs, and
+// streams that are opened by the server side have even IDs.
+func newSession(conn io.ReadWriteCloser, config *Config, firstID uint32) *Session {
+	if config == nil {
+		config = &Config{}
+	}
+	s := &Session{
+		conn:    conn,
+		window:  config.Window,
+		streams: make(map[uint32]*Stream),
+		nextID:  firstID,
+		client:  firstID%2 == 1,
+		closed:  make(chan struct{}),
+	}
+	if s.window == 0 {
+		s.window = DefaultWindow
+	}
+	backlog := config.AcceptBacklog
+	if backlog == 0 {
+		backlog = DefaultAcceptBacklog
+	}
+	s.accept = make(chan *Stream, backlog)
+	go s.recvLoop()
+	return s
+}
+
+// OpenStream opens a new stream, which is accepted by the other side with AcceptStream.
+func (s *Session) OpenStream() (*Stream, error) {
+	s.mu.Lock()
+	if isClosed(s.closed) {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newStream(s, id)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(typeData, flagSYN, id, 0, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// AcceptStream waits for and returns the next stream that is opened by the other side.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.closed:
+		return nil, ErrSessionClosed
+	}
+}
+
+// Accept waits for and returns the next stream that is opened by the other side.
+func (s *Session) Accept() (net.Conn, error) {
+	return s.AcceptStream()
+}
+
+// Addr returns the local address of the underlying connection.
+func (s *Session) Addr() net.Addr {
+	return s.localAddr()
+}
+
+// Close closes the session and the underlying connection.
+// All streams are closed.
+func (s *Session) Close() error {
+	return s.close(ErrSessionClosed)
+}
+
+// Done returns a channel that is closed when the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+// Err returns the error that closed the session.
+// It should be called after the Done channel is closed.
+func (s *Session) Err() error {
+	select {
+	case <-s.closed:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+func (s *Session) close(err error) error {
+	var closeErr error
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		close(s.closed)
+		s.mu.Unlock()
+		closeErr = s.conn.Close()
+	})
+	return closeErr
+}
+
+// writeFrame writes a frame with a single write to the underlying connection.
+func (s *Session) writeFrame(typ, flags uint8, id, length uint32, payload []byte) error {
+	s.wLock.Lock()
+	defer s.wLock.Unlock()
+
+	if isClosed(s.closed) {
+		return ErrSessionClosed
+	}
+
+	s.wBuf = append(s.wBuf[:0], typ, flags)
+	s.wBuf = binary.BigEndian.AppendUint32(s.wBuf, id)
+	s.wBuf = binary.BigEndian.AppendUint32(s.wBuf, length)
+	s.wBuf = append(s.wBuf, payload...)
+	if _, err := s.conn.Write(s.wBuf); err != nil {
+		s.close(err)
+		return err
+	}
+	return nil
+}
+
+// reset resets a stream in the background, such that the receive loop is not blocked.
+func (s *Session) reset(id uint32) {
+	go s.writeFrame(typeData, flagRST, id, 0, nil)
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// recvLoop reads frames from the underlying connection and dispatches them to the streams.
+func (s *Session) recvLoop() {
+	err := s.recv()
+	if err == io.EOF {
+		err = ErrSessionClosed
+	}
+	s.close(err)
+}
+
+func (s *Session) recv() error {
+	var hdr [headerSize]byte
+	var buf []byte
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			return err
+		}
+		typ, flags := hdr[0], hdr[1]
+		id := binary.BigEndian.Uint32(hdr[2:6])
+		length := binary.BigEndian.Uint32(hdr[6:10])
+
+		switch typ {
+		case typeData:
+			if length > maxFrameSize {
+				return fmt.Errorf("mux: frame size %d exceeds maximum of %d", length, maxFrameSize)
+			}
+			buf = buf[:0]
+			if length > 0 {
+				if cap(buf) < int(length) {
+					buf = make([]byte, maxFrameSize)
+				}
+				buf = buf[:length]
+				if _, err := io.ReadFull(s.conn, buf); err != nil {
+					return err
+				}
+			}
+			if err := s.handleData(flags, id, buf); err != nil {
+				return err
+			}
+		case typeWindowUpdate:
+			if stream := s.stream(id); stream != nil {
+				stream.incSendWindow(length)
+			}
+		default:
+			return fmt.Errorf("mux: unknown frame type %d", typ)
+		}
+	}
+}
+
+func (s *Session) handleData(flags uint8, id uint32, payload []byte) error {
+	if flags&flagSYN != 0 {
+		if (id%2 == 1) == s.client {
+			return fmt.Errorf("mux: stream %d opened with an invalid ID", id)
+		}
+		s.mu.Lock()
+		_, ok := s.streams[id]
+		stream := newStream(s, id)
+		if !ok {
+			s.streams[id] = stream
+		}
+		s.mu.Unlock()
+		if ok {
+			return fmt.Errorf("mux: stream %d was opened twice", id)
+		}
+		select {
+		case s.accept <- stream:
+		default:
+			// The accept backlog is full.
+			s.removeStream(id)
+			s.reset(id)
+			return nil
+		}
+	}
+
+	stream := s.stream(id)
+	if stream == nil {
+		// The stream was already closed on this side.
+		if flags&flagRST == 0 && len(payload) > 0 {
+			s.reset(id)
+		}
+		return nil
+	}
+	return stream.recv(flags, payload)
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) localAddr() net.Addr {
+	if c, ok := s.conn.(interface{ LocalAddr() net.Addr }); ok {
+		return c.LocalAddr()
+	}
+	return addr("mux")
+}
+
+func (s *Session) remoteAddr() net.Addr {
+	if c, ok := s.conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return c.RemoteAddr()
+	}
+	return addr("mux")
+}
+
+// addr is a placeholder net.Addr, used when the underlying connection has no addresses.
+type addr string
+
+func (a addr) Network() string { return "mux" }
+func (a addr) String() string  { return string(a) }
+
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
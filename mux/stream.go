@@ -0,0 +1,366 @@
+package mux
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a logical stream of a Session.
+// It implements the net.Conn interface.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	// wLock serializes writes, such that data of concurrent writes is not interleaved.
+	wLock sync.Mutex
+
+	// mu guards the stream state.
+	mu sync.Mutex
+	// buf holds data that was received and not read yet.
+	buf bytes.Buffer
+	// recvWindow is the amount of data that the other side may still send.
+	recvWindow uint32
+	// unacked is the amount of data that was read, and not yet acknowledged by a window update.
+	unacked uint32
+	// sendWindow is the amount of data that may still be sent.
+	sendWindow uint32
+
+	finSent bool // finSent is set when the write side is closed.
+	finRecv bool // finRecv is set when the other side closed its write side.
+	reset   bool // reset is set when the stream was reset by the other side.
+	closed  bool // closed is set when the stream was closed on this side.
+
+	readDeadline, writeDeadline time.Time
+
+	// readCh and writeCh notify blocked reads and writes that the stream state has changed.
+	readCh  chan struct{}
+	writeCh chan struct{}
+}
+
+func newStream(session *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    session,
+		recvWindow: session.window,
+		sendWindow: session.window,
+		readCh:     make(chan struct{}, 1),
+		writeCh:    make(chan struct{}, 1),
+	}
+}
+
+// ID returns the stream ID.
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Read reads data from the stream.
+// It returns io.EOF after the other side closed its write side and all data was read.
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for {
+		if s.closed {
+			s.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if s.buf.Len() > 0 {
+			n, _ := s.buf.Read(p)
+			update := s.ack(n)
+			s.mu.Unlock()
+			if update > 0 {
+				s.session.writeFrame(typeWindowUpdate, 0, s.id, update, nil)
+			}
+			return n, nil
+		}
+		switch {
+		case s.finRecv:
+			s.mu.Unlock()
+			return 0, io.EOF
+		case s.reset:
+			s.mu.Unlock()
+			return 0, ErrStreamReset
+		case isClosed(s.session.closed):
+			s.mu.Unlock()
+			return 0, s.session.err
+		}
+		if len(p) == 0 {
+			s.mu.Unlock()
+			return 0, nil
+		}
+
+		deadline := s.readDeadline
+		s.mu.Unlock()
+		if err := s.wait(s.readCh, deadline); err != nil {
+			return 0, err
+		}
+		s.mu.Lock()
+	}
+}
+
+// ack acknowledges read data. It returns the window increment that should be sent to the
+// other side, which is sent when at least half of the window was read.
+// It should be called with the lock held.
+func (s *Stream) ack(n int) uint32 {
+	if s.finRecv {
+		return 0
+	}
+	s.unacked += uint32(n)
+	if s.unacked < s.session.window/2 {
+		return 0
+	}
+	update := s.unacked
+	s.unacked = 0
+	s.recvWindow += update
+	return update
+}
+
+// Write writes data to the stream.
+// It blocks while the flow control window of the stream is exhausted.
+func (s *Stream) Write(p []byte) (int, error) {
+	s.wLock.Lock()
+	defer s.wLock.Unlock()
+
+	total := 0
+	for total < len(p) {
+		n, err := s.reserve(len(p) - total)
+		if err != nil {
+			return total, err
+		}
+		if err := s.session.writeFrame(typeData, 0, s.id, uint32(n), p[total:total+n]); err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// reserve waits until data can be sent, and reserves up to size bytes of the send window.
+func (s *Stream) reserve(size int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		switch {
+		case s.closed || s.finSent:
+			return 0, net.ErrClosed
+		case s.reset:
+			return 0, ErrStreamReset
+		case isClosed(s.session.closed):
+			return 0, s.session.err
+		case !s.writeDeadline.IsZero() && !time.Now().Before(s.writeDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		if s.sendWindow > 0 {
+			break
+		}
+
+		deadline := s.writeDeadline
+		s.mu.Unlock()
+		err := s.wait(s.writeCh, deadline)
+		s.mu.Lock()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := size
+	if n > maxFrameSize {
+		n = maxFrameSize
+	}
+	if uint32(n) > s.sendWindow {
+		n = int(s.sendWindow)
+	}
+	s.sendWindow -= uint32(n)
+	return n, nil
+}
+
+// wait waits for a notification on ch, until the deadline or until the session is closed.
+func (s *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ch:
+	case <-s.session.closed:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// recv handles a data frame from the other side.
+func (s *Stream) recv(flags uint8, payload []byte) error {
+	s.mu.Lock()
+	if flags&flagRST != 0 {
+		s.reset = true
+		s.mu.Unlock()
+		s.notify()
+		s.session.removeStream(s.id)
+		return nil
+	}
+
+	switch {
+	case len(payload) == 0 || s.finRecv:
+		// Data after FIN might be sent if the other side closed while writing, it is ignored.
+	case s.closed:
+		// The stream was closed on this side, and the data can't be read.
+		s.mu.Unlock()
+		s.session.removeStream(s.id)
+		s.session.reset(s.id)
+		return nil
+	case uint32(len(payload)) > s.recvWindow:
+		s.mu.Unlock()
+		return fmt.Errorf("mux: stream %d exceeded its flow control window", s.id)
+	default:
+		s.recvWindow -= uint32(len(payload))
+		s.buf.Write(payload)
+	}
+
+	var done bool
+	if flags&flagFIN != 0 {
+		s.finRecv = true
+		done = s.finSent
+	}
+	s.mu.Unlock()
+	s.notify()
+	if done {
+		s.session.removeStream(s.id)
+	}
+	return nil
+}
+
+// incSendWindow handles a window update from the other side.
+func (s *Stream) incSendWindow(update uint32) {
+	s.mu.Lock()
+	s.sendWindow += update
+	s.mu.Unlock()
+	notify(s.writeCh)
+}
+
+// notify notifies blocked reads and writes that the stream state has changed.
+func (s *Stream) notify() {
+	notify(s.readCh)
+	notify(s.writeCh)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// CloseWrite closes the write side of the stream.
+// The other side will read the remaining data and then get an io.EOF, and can keep
+// sending data which can be read on this side.
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	if s.finSent || s.reset {
+		s.mu.Unlock()
+		return nil
+	}
+	s.finSent = true
+	done := s.finRecv
+	s.mu.Unlock()
+	notify(s.writeCh)
+
+	err := s.session.writeFrame(typeData, flagFIN, s.id, 0, nil)
+	if done {
+		s.session.removeStream(s.id)
+	}
+	return err
+}
+
+// Close closes the stream.
+// Any blocked Read or Write operations will be unblocked and return errors.
+// If there is unread data, the stream is reset, otherwise the write side is closed and the
+// stream is reset only if the other side sends more data.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	unread := s.buf.Len() > 0
+	s.buf.Reset()
+	finSent, reset := s.finSent, s.reset
+	s.finSent = true
+	done := reset || unread || s.finRecv
+	s.mu.Unlock()
+	s.notify()
+
+	var err error
+	switch {
+	case reset:
+	case unread:
+		err = s.session.writeFrame(typeData, flagRST, s.id, 0, nil)
+	case !finSent:
+		err = s.session.writeFrame(typeData, flagFIN, s.id, 0, nil)
+	}
+	if done {
+		s.session.removeStream(s.id)
+	}
+	if err == ErrSessionClosed {
+		err = nil
+	}
+	return err
+}
+
+// LocalAddr returns the local address of the underlying connection.
+func (s *Stream) LocalAddr() net.Addr {
+	return s.session.localAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying connection.
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.session.remoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines associated with the stream.
+func (s *Stream) SetDeadline(t time.Time) error {
+	if err := s.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future Read calls and any currently-blocked Read call.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return net.ErrClosed
+	}
+	s.readDeadline = t
+	notify(s.readCh)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future Write calls and any currently-blocked Write call.
+// A write that is blocked on the underlying connection, and not on the stream flow control,
+// is not interrupted.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return net.ErrClosed
+	}
+	s.writeDeadline = t
+	notify(s.writeCh)
+	return nil
+}
@@ -0,0 +1,41 @@
+package h2conn
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrProtocolNotSupported is returned by Connect if the server selected a protocol that the
+// client does not support.
+var ErrProtocolNotSupported = errors.New("protocol not supported")
+
+// protocolHeader is the header in which the client sends the protocols it supports, in order of
+// preference, and the server responds with the selected protocol.
+const protocolHeader = "H2conn-Protocol"
+
+// parseProtocols returns the protocols in the protocol header.
+func parseProtocols(h http.Header) []string {
+	var protocols []string
+	for _, v := range h.Values(protocolHeader) {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				protocols = append(protocols, p)
+			}
+		}
+	}
+	return protocols
+}
+
+// selectProtocol returns the first supported protocol that was offered, or an empty string if
+// there is none.
+func selectProtocol(supported, offered []string) string {
+	for _, s := range supported {
+		for _, o := range offered {
+			if s == o {
+				return s
+			}
+		}
+	}
+	return ""
+}
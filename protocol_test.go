@@ -0,0 +1,106 @@
+package h2conn
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/posener/h2conn/h2test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocol(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		serverProtocols []string
+		clientProtocols []string
+		serverHeader    http.Header
+		want            string
+		wantErr         error
+	}{
+		{
+			name:            "server preference",
+			serverProtocols: []string{"v1", "v2"},
+			clientProtocols: []string{"v2", "v1"},
+			want:            "v1",
+		},
+		{
+			name:            "single match",
+			serverProtocols: []string{"v2", "v3"},
+			clientProtocols: []string{"v1", "v2"},
+			want:            "v2",
+		},
+		{
+			name:            "no match",
+			serverProtocols: []string{"v3"},
+			clientProtocols: []string{"v1", "v2"},
+		},
+		{
+			name:            "client without protocols",
+			serverProtocols: []string{"v1"},
+		},
+		{
+			name:            "server without protocols",
+			clientProtocols: []string{"v1"},
+		},
+		{
+			name:            "unsupported server protocol",
+			clientProtocols: []string{"v1"},
+			serverHeader:    http.Header{protocolHeader: []string{"v9"}},
+			wantErr:         ErrProtocolNotSupported,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			u := Server{Protocols: tt.serverProtocols, Header: tt.serverHeader}
+			server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := u.Accept(w, r)
+				require.NoError(t, err)
+				if tt.wantErr == nil {
+					assert.Equal(t, tt.want, conn.Protocol())
+				}
+			}))
+			defer server.Close()
+
+			cl := insecureClient
+			cl.Protocols = tt.clientProtocols
+			conn, _, err := cl.Connect(context.Background(), server.URL)
+			if tt.wantErr != nil {
+				assert.Equal(t, tt.wantErr, err)
+				return
+			}
+			require.NoError(t, err)
+			defer conn.Close()
+			assert.Equal(t, tt.want, conn.Protocol())
+		})
+	}
+}
+
+func TestServerHeader(t *testing.T) {
+	t.Parallel()
+
+	u := Server{Header: http.Header{"Foo": []string{"bar"}}}
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := u.Accept(w, r)
+		require.NoError(t, err)
+		// Modifying the response header does not modify the server header.
+		w.Header()["Foo"][0] = "baz"
+	}))
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, resp, err := insecureClient.Connect(context.Background(), server.URL)
+		require.NoError(t, err)
+		assert.Equal(t, "bar", resp.Header.Get("Foo"))
+		assert.Equal(t, "bar", conn.Header().Get("Foo"))
+		conn.Close()
+	}
+	assert.Equal(t, "bar", u.Header.Get("Foo"))
+}
@@ -0,0 +1,214 @@
+package h2conn
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimit configures the rate limits of a connection, in bytes per second.
+type RateLimit struct {
+	// ReadRate, if set, limits the rate in which data is read from the other side. Data is
+	// not read from the underlying stream above the rate, such that the other side is blocked
+	// by the HTTP2 flow control.
+	ReadRate float64
+	// ReadBurst is the maximal number of bytes that can be read at once.
+	// The default, if not set, is the number of bytes of one second at the ReadRate.
+	ReadBurst int
+	// WriteRate, if set, limits the rate in which data is written to the other side.
+	WriteRate float64
+	// WriteBurst is the maximal number of bytes that can be written at once.
+	// The default, if not set, is the number of bytes of one second at the WriteRate.
+	WriteBurst int
+	// ReadLimiter, if set, limits the read rate together with other connections that use
+	// it, in addition to the ReadRate.
+	ReadLimiter *Limiter
+	// WriteLimiter, if set, limits the write rate together with other connections that use
+	// it, in addition to the WriteRate.
+	WriteLimiter *Limiter
+}
+
+// Limiter is a token bucket rate limiter of bytes. It can be shared by a group of connections
+// to limit their total rate, using RateLimit.ReadLimiter and RateLimit.WriteLimiter.
+type Limiter struct {
+	rate  float64
+	burst int
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter of the given rate in bytes per second, and allows bursts of up
+// to burst bytes. If burst is not positive, it is the number of bytes of one second at the
+// rate. If the rate is not positive, the limiter does not limit.
+//
+// Usage:
+//
+//      // Limit the total upload rate of all the clients to 1MB per second.
+//      shared := h2conn.NewLimiter(1<<20, 64<<10)
+//      server := &h2conn.Server{RateLimit: h2conn.RateLimit{ReadLimiter: shared}}
+//
+func NewLimiter(bytesPerSecond float64, burst int) *Limiter {
+	if burst <= 0 {
+		burst = int(math.Max(bytesPerSecond, 1))
+	}
+	return &Limiter{rate: bytesPerSecond, burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// wait waits until n bytes, which should not exceed the burst, can be transferred.
+// It returns net.ErrClosed if done is closed before.
+func (l *Limiter) wait(done <-chan struct{}, n int) error {
+	d := l.reserve(n)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-done:
+		l.refund(n)
+		return net.ErrClosed
+	}
+}
+
+// reserve takes n tokens, and returns the duration until they are available.
+func (l *Limiter) reserve(n int) time.Duration {
+	if l.rate <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens = math.Min(float64(l.burst), l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// refund returns tokens that were not used.
+func (l *Limiter) refund(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = math.Min(float64(l.burst), l.tokens+float64(n))
+}
+
+// limiters returns the read and write limiters of a connection.
+func (rl RateLimit) limiters() (read, write []*Limiter) {
+	if rl.ReadRate > 0 {
+		read = append(read, NewLimiter(rl.ReadRate, rl.ReadBurst))
+	}
+	if rl.ReadLimiter != nil {
+		read = append(read, rl.ReadLimiter)
+	}
+	if rl.WriteRate > 0 {
+		write = append(write, NewLimiter(rl.WriteRate, rl.WriteBurst))
+	}
+	if rl.WriteLimiter != nil {
+		write = append(write, rl.WriteLimiter)
+	}
+	return read, write
+}
+
+// enableRateLimit limits the rate of reads and writes of the connection.
+// It should be called before the connection is used, and after heartbeats are enabled, such
+// that heartbeats are not limited.
+func (c *Conn) enableRateLimit(rl RateLimit) {
+	read, write := rl.limiters()
+	if len(read) > 0 {
+		c.r = &limitReader{ReadCloser: c.r, br: bufio.NewReader(c.r), limiters: read, done: c.closed}
+	}
+	if len(write) > 0 {
+		c.wc = &limitWriter{WriteCloser: c.wc, limiters: write, done: c.closed}
+	}
+}
+
+// chunkSize returns the number of bytes that can be transferred at once by all the limiters.
+func chunkSize(limiters []*Limiter, n int) int {
+	for _, l := range limiters {
+		if l.rate > 0 && n > l.burst {
+			n = l.burst
+		}
+	}
+	return n
+}
+
+// waitAll waits until n bytes can be transferred by all the limiters.
+func waitAll(limiters []*Limiter, done <-chan struct{}, n int) error {
+	for i, l := range limiters {
+		if err := l.wait(done, n); err != nil {
+			for _, prev := range limiters[:i] {
+				prev.refund(n)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// limitReader limits the rate of reads from the underlying reader.
+type limitReader struct {
+	io.ReadCloser
+	br       *bufio.Reader
+	limiters []*Limiter
+	done     <-chan struct{}
+}
+
+// Read waits for data before it waits for the limiters, such that only received data is
+// charged, and idle connections do not take the tokens of a shared limiter.
+func (r *limitReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := r.br.Peek(1); err != nil {
+		return 0, err
+	}
+	n := len(p)
+	if buffered := r.br.Buffered(); n > buffered {
+		n = buffered
+	}
+	n = chunkSize(r.limiters, n)
+	if err := waitAll(r.limiters, r.done, n); err != nil {
+		return 0, err
+	}
+	// The data is buffered, so exactly n bytes are read.
+	return r.br.Read(p[:n])
+}
+
+// limitWriter limits the rate of writes to the underlying writer.
+type limitWriter struct {
+	io.WriteCloser
+	limiters []*Limiter
+	done     <-chan struct{}
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n := chunkSize(w.limiters, len(p)-written)
+		if err := waitAll(w.limiters, w.done, n); err != nil {
+			return written, err
+		}
+		m, err := w.WriteCloser.Write(p[written : written+n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (w *limitWriter) Flush() error {
+	if f, ok := w.WriteCloser.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
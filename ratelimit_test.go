@@ -0,0 +1,184 @@
+package h2conn
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/posener/h2conn/h2test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	t.Parallel()
+
+	l := NewLimiter(1000, 100)
+	start := time.Now()
+	require.NoError(t, l.wait(nil, 100))
+	assert.True(t, time.Since(start) < 50*time.Millisecond, "burst should not wait")
+
+	require.NoError(t, l.wait(nil, 100))
+	assert.True(t, time.Since(start) >= 90*time.Millisecond, "took %v", time.Since(start))
+
+	// A closed done channel stops the wait, and the tokens are returned.
+	done := make(chan struct{})
+	close(done)
+	assert.Error(t, l.wait(done, 100))
+	start = time.Now()
+	require.NoError(t, l.wait(nil, 100))
+	assert.True(t, time.Since(start) >= 90*time.Millisecond, "took %v", time.Since(start))
+
+	// The default burst is one second of the rate.
+	assert.Equal(t, 2000, NewLimiter(2000, 0).burst)
+	assert.Equal(t, 1, NewLimiter(0.5, 0).burst)
+
+	// A limiter without a positive rate does not limit.
+	for _, rate := range []float64{0, -1} {
+		unlimited := NewLimiter(rate, 0)
+		start = time.Now()
+		for i := 0; i < 10; i++ {
+			require.NoError(t, unlimited.wait(nil, 1000))
+		}
+		assert.True(t, time.Since(start) < 50*time.Millisecond, "took %v", time.Since(start))
+		assert.Equal(t, 1000, chunkSize([]*Limiter{unlimited}, 1000))
+	}
+}
+
+func TestRateLimitWrite(t *testing.T) {
+	t.Parallel()
+
+	serverRead := make(chan []byte, 1)
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Accept(w, r)
+		require.NoError(t, err)
+		defer conn.Close()
+		got, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		serverRead <- got
+	}))
+	defer server.Close()
+
+	cl := insecureClient
+	cl.RateLimit = RateLimit{WriteRate: 10000, WriteBurst: 1000}
+	conn, _, err := cl.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("a"), 5000)
+	start := time.Now()
+	n, err := conn.Write(data)
+	require.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	require.NoError(t, conn.Close())
+	assert.Equal(t, data, <-serverRead)
+	// The first 1000 bytes are a burst, and the rest are written in 10000 bytes per second.
+	assert.True(t, time.Since(start) >= 350*time.Millisecond, "took %v", time.Since(start))
+}
+
+func TestRateLimitRead(t *testing.T) {
+	t.Parallel()
+
+	u := Server{RateLimit: RateLimit{ReadRate: 10000, ReadBurst: 1000}}
+	serverRead := make(chan []byte, 1)
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := u.Accept(w, r)
+		require.NoError(t, err)
+		defer conn.Close()
+		got, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		serverRead <- got
+	}))
+	defer server.Close()
+
+	conn, _, err := insecureClient.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("a"), 5000)
+	start := time.Now()
+	_, err = conn.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	assert.Equal(t, data, <-serverRead)
+	assert.True(t, time.Since(start) >= 350*time.Millisecond, "took %v", time.Since(start))
+}
+
+// TestRateLimitShared tests that a shared limiter limits the total rate of connections.
+func TestRateLimitShared(t *testing.T) {
+	t.Parallel()
+
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Accept(w, r)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = io.Copy(io.Discard, conn)
+		assert.NoError(t, err)
+	}))
+	defer server.Close()
+
+	cl := insecureClient
+	cl.RateLimit = RateLimit{WriteLimiter: NewLimiter(10000, 1000)}
+
+	data := bytes.Repeat([]byte("a"), 2500)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, _, err := cl.Connect(context.Background(), server.URL)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+			_, err = conn.Write(data)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.True(t, time.Since(start) >= 350*time.Millisecond, "took %v", time.Since(start))
+}
+
+// TestRateLimitSharedIdle tests that idle connections do not take the tokens of a shared read
+// limiter.
+func TestRateLimitSharedIdle(t *testing.T) {
+	t.Parallel()
+
+	u := Server{RateLimit: RateLimit{ReadLimiter: NewLimiter(10000, 1000)}}
+	serverRead := make(chan []byte, 1)
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := u.Accept(w, r)
+		require.NoError(t, err)
+		defer conn.Close()
+		got, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		if r.URL.Path != "/idle" {
+			serverRead <- got
+		}
+	}))
+	defer server.Close()
+
+	for i := 0; i < 5; i++ {
+		idle, _, err := insecureClient.Connect(context.Background(), server.URL+"/idle")
+		require.NoError(t, err)
+		defer idle.Close()
+	}
+	// Let the idle connections wait for data.
+	time.Sleep(50 * time.Millisecond)
+
+	conn, _, err := insecureClient.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	data := bytes.Repeat([]byte("a"), 3000)
+	start := time.Now()
+	_, err = conn.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	assert.Equal(t, data, <-serverRead)
+	// The first 1000 bytes are a burst, and the rest are read in 10000 bytes per second.
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 150*time.Millisecond, "took %v", elapsed)
+	assert.True(t, elapsed < 450*time.Millisecond, "took %v", elapsed)
+}
@@ -0,0 +1,307 @@
+package h2conn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Backoff configures the delays between reconnection attempts.
+// The delay grows exponentially from Initial to Max.
+type Backoff struct {
+	// Initial is the delay before the first reconnection attempt.
+	// The default, if not set, is 100 milliseconds.
+	Initial time.Duration
+	// Max is the maximal delay between reconnection attempts.
+	// The default, if not set, is 30 seconds.
+	Max time.Duration
+	// Multiplier is the factor by which the delay grows after each failed attempt.
+	// The default, if not set, is 2.
+	Multiplier float64
+	// Jitter is the fraction of the delay that is randomized, between 0 and 1, such that many
+	// clients that were disconnected together do not reconnect together.
+	// The default, if not set, is no jitter.
+	Jitter float64
+}
+
+// Delay returns the delay before the given reconnection attempt, starting from 0.
+func (b Backoff) Delay(attempt int) time.Duration {
+	initial, max, multiplier := b.Initial, b.Max, b.Multiplier
+	if initial <= 0 {
+		initial = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	d := float64(initial) * math.Pow(multiplier, float64(attempt))
+	if d > float64(max) {
+		d = float64(max)
+	}
+	if b.Jitter > 0 {
+		d -= d * math.Min(b.Jitter, 1) * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// ReconnectingConn is a client side connection that reconnects to the server when the
+// connection breaks, because of a network error, a GOAWAY, or the server closing it with
+// CloseGoingAway, for example when it restarts. Reconnection attempts are delayed according to
+// the Backoff configuration. A connection that the server ends on purpose is not reconnected:
+// Read returns io.EOF, or the *CloseError of the server.
+//
+// Read and Write block while the connection is reconnecting, and continue on the new
+// connection. Data that was in flight when the connection broke might be lost, so the
+// OnConnect callback should be used to restore the application state with the server.
+//
+// Usage:
+//
+//      conn := &h2conn.ReconnectingConn{
+//          URL: url,
+//          OnConnect: func(conn *h2conn.Conn, resp *http.Response) error {
+//              return login(conn)
+//          },
+//      }
+//      if err := conn.Connect(ctx); err != nil {
+//          log.Fatalf("Initiate client: %s", err)
+//      }
+//      defer conn.Close()
+//
+//      // use conn
+//
+type ReconnectingConn struct {
+	// Client is used to connect to the server.
+	// The default, if not set, is the default client configuration.
+	Client *Client
+	// URL is the URL of the server.
+	URL string
+	// Backoff configures the delays between reconnection attempts.
+	Backoff Backoff
+	// OnConnect, if set, is called after every successful connection, before the connection
+	// is used by Read and Write. If it returns an error the connection is closed, and it is
+	// treated as a failed attempt.
+	OnConnect func(conn *Conn, resp *http.Response) error
+	// OnDisconnect, if set, is called with the error that broke the connection, before
+	// reconnecting.
+	OnDisconnect func(err error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	conn   *Conn
+	closed bool
+	// gen is increased on every disconnection, such that an error of a previous connection
+	// does not break the current one.
+	gen int
+	// connected is closed when a connection is available.
+	connected chan struct{}
+}
+
+// Connect connects to the server.
+// The first connection attempt is not retried, and its error is returned. The context bounds
+// the lifetime of the connection, including future reconnections.
+func (rc *ReconnectingConn) Connect(ctx context.Context) error {
+	rc.ctx, rc.cancel = context.WithCancel(ctx)
+	conn, err := rc.dial()
+	if err != nil {
+		rc.cancel()
+		return err
+	}
+	rc.mu.Lock()
+	rc.conn = conn
+	rc.connected = make(chan struct{})
+	close(rc.connected)
+	rc.mu.Unlock()
+	return nil
+}
+
+// Read reads data from the connection.
+func (rc *ReconnectingConn) Read(data []byte) (int, error) {
+	for {
+		conn, gen, err := rc.acquire()
+		if err != nil {
+			return 0, err
+		}
+		n, err := conn.Read(data)
+		if err == nil || n > 0 {
+			return n, nil
+		}
+		if rc.ctx.Err() != nil {
+			return 0, rc.err()
+		}
+		if !reconnectable(err) {
+			return 0, err
+		}
+		rc.disconnect(gen, err)
+	}
+}
+
+// Write writes data to the connection.
+// If the connection breaks during the write, the remaining data is written to the next
+// connection.
+func (rc *ReconnectingConn) Write(data []byte) (int, error) {
+	written := 0
+	for {
+		conn, gen, err := rc.acquire()
+		if err != nil {
+			return written, err
+		}
+		n, err := conn.Write(data[written:])
+		written += n
+		if err == nil {
+			return written, nil
+		}
+		if rc.ctx.Err() != nil {
+			return written, rc.err()
+		}
+		if !reconnectable(err) {
+			return written, err
+		}
+		rc.disconnect(gen, err)
+	}
+}
+
+// Close closes the connection and stops reconnecting.
+func (rc *ReconnectingConn) Close() error {
+	rc.mu.Lock()
+	if rc.closed {
+		rc.mu.Unlock()
+		return nil
+	}
+	rc.closed = true
+	conn := rc.conn
+	rc.mu.Unlock()
+
+	if rc.cancel != nil {
+		rc.cancel()
+	}
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+// acquire waits until a connection is available.
+func (rc *ReconnectingConn) acquire() (*Conn, int, error) {
+	for {
+		rc.mu.Lock()
+		conn, gen, connected, closed := rc.conn, rc.gen, rc.connected, rc.closed
+		rc.mu.Unlock()
+		switch {
+		case closed || connected == nil:
+			return nil, 0, net.ErrClosed
+		case conn != nil:
+			return conn, gen, nil
+		}
+		select {
+		case <-connected:
+		case <-rc.ctx.Done():
+			return nil, 0, rc.err()
+		}
+	}
+}
+
+func (rc *ReconnectingConn) err() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return net.ErrClosed
+	}
+	return rc.ctx.Err()
+}
+
+// reconnectable returns true if a connection that failed with the error should be reconnected.
+// Errors of the transport are reconnected, but not a clean end of the stream, a close
+// error that the server sent on purpose, or a deadline of the caller.
+func reconnectable(err error) bool {
+	var closeErr *CloseError
+	switch {
+	case errors.As(err, &closeErr):
+		return closeErr.Code == CloseGoingAway
+	case err == io.EOF, errors.Is(err, os.ErrDeadlineExceeded):
+		return false
+	}
+	return true
+}
+
+// disconnect handles an error of the connection of the given generation, and starts reconnecting.
+func (rc *ReconnectingConn) disconnect(gen int, err error) {
+	rc.mu.Lock()
+	if rc.closed || rc.conn == nil || gen != rc.gen {
+		rc.mu.Unlock()
+		return
+	}
+	conn := rc.conn
+	rc.conn = nil
+	rc.gen++
+	rc.connected = make(chan struct{})
+	rc.mu.Unlock()
+
+	conn.Close()
+	if rc.OnDisconnect != nil {
+		rc.OnDisconnect(err)
+	}
+	go rc.reconnect()
+}
+
+// reconnect dials the server until it succeeds, or the connection is closed.
+func (rc *ReconnectingConn) reconnect() {
+	for attempt := 0; ; attempt++ {
+		t := time.NewTimer(rc.Backoff.Delay(attempt))
+		select {
+		case <-t.C:
+		case <-rc.ctx.Done():
+			t.Stop()
+			return
+		}
+
+		conn, err := rc.dial()
+		if err != nil {
+			continue
+		}
+		rc.mu.Lock()
+		if rc.closed {
+			rc.mu.Unlock()
+			conn.Close()
+			return
+		}
+		rc.conn = conn
+		close(rc.connected)
+		rc.mu.Unlock()
+		return
+	}
+}
+
+// dial connects to the server, and calls the OnConnect callback.
+func (rc *ReconnectingConn) dial() (*Conn, error) {
+	client := rc.Client
+	if client == nil {
+		client = &defaultClient
+	}
+	conn, resp, err := client.Connect(rc.ctx, rc.URL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("bad status code %d", resp.StatusCode)
+	}
+	if rc.OnConnect != nil {
+		if err := rc.OnConnect(conn, resp); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,191 @@
+package h2conn
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/posener/h2conn/h2test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestReconnectingConn tests reconnection after the server breaks the connection.
+func TestReconnectingConn(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu       sync.Mutex
+		numConns int
+	)
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		numConns++
+		n := numConns
+		mu.Unlock()
+
+		conn, err := Accept(w, r)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		buf := bufio.NewReader(conn)
+		login, err := buf.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "login\n", login)
+		_, err = fmt.Fprintf(conn, "welcome %d\n", n)
+		require.NoError(t, err)
+
+		// Close the first connection as if the server is restarting.
+		if n == 1 {
+			conn.CloseWithError(CloseGoingAway, "restarting")
+			return
+		}
+
+		// Echo lines in upper case.
+		for {
+			msg, err := buf.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			_, err = conn.Write(bytes.ToUpper(msg))
+			if err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	var numConnects, numDisconnects int
+	conn := &ReconnectingConn{
+		Client:  &insecureClient,
+		URL:     server.URL,
+		Backoff: Backoff{Initial: time.Millisecond, Jitter: 0.5},
+		OnConnect: func(conn *Conn, resp *http.Response) error {
+			numConnects++
+			_, err := conn.Write([]byte("login\n"))
+			return err
+		},
+		OnDisconnect: func(err error) {
+			numDisconnects++
+		},
+	}
+	require.NoError(t, conn.Connect(context.Background()))
+	defer conn.Close()
+
+	buf := bufio.NewReader(conn)
+	for _, want := range []string{"welcome 1\n", "welcome 2\n"} {
+		got, err := buf.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	_, err := conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	got, err := buf.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HELLO\n", got)
+
+	assert.Equal(t, 2, numConnects)
+	assert.Equal(t, 1, numDisconnects)
+
+	require.NoError(t, conn.Close())
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+// TestReconnectingConnServerEnd tests that a connection that the server ends on purpose is not
+// reconnected.
+func TestReconnectingConnServerEnd(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		close   func(conn *Conn)
+		wantErr error
+	}{
+		{
+			name:    "end of stream",
+			close:   func(conn *Conn) { conn.Close() },
+			wantErr: io.EOF,
+		},
+		{
+			name:    "close error",
+			close:   func(conn *Conn) { conn.CloseWithError(3, "kicked") },
+			wantErr: &CloseError{Code: 3, Reason: "kicked"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				mu       sync.Mutex
+				numConns int
+			)
+			server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				numConns++
+				mu.Unlock()
+				conn, err := Accept(w, r)
+				require.NoError(t, err)
+				_, err = conn.Write([]byte("bye"))
+				assert.NoError(t, err)
+				tt.close(conn)
+			}))
+			defer server.Close()
+
+			conn := &ReconnectingConn{Client: &insecureClient, URL: server.URL, Backoff: Backoff{Initial: time.Millisecond}}
+			require.NoError(t, conn.Connect(context.Background()))
+			defer conn.Close()
+
+			got, err := io.ReadAll(conn)
+			assert.Equal(t, "bye", string(got))
+			if tt.wantErr != io.EOF {
+				assert.Equal(t, tt.wantErr, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			_, err = conn.Read(make([]byte, 1))
+			assert.Equal(t, tt.wantErr, err)
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, 1, numConns)
+		})
+	}
+}
+
+// TestReconnectingConnFirstAttempt tests that a failure of the first connection is returned.
+func TestReconnectingConnFirstAttempt(t *testing.T) {
+	t.Parallel()
+
+	server := h2test.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	conn := &ReconnectingConn{Client: &insecureClient, URL: server.URL}
+	assert.Error(t, conn.Connect(context.Background()))
+}
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+
+	b := Backoff{Initial: time.Second, Max: 5 * time.Second, Multiplier: 2}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		assert.Equal(t, want, b.Delay(attempt))
+	}
+
+	b.Jitter = 0.5
+	for attempt := 0; attempt < 10; attempt++ {
+		d := b.Delay(attempt)
+		assert.True(t, d <= 5*time.Second, "delay %s", d)
+		assert.True(t, d >= time.Second/2, "delay %s", d)
+	}
+}
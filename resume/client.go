@@ -0,0 +1,115 @@
+package resume
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/posener/h2conn"
+)
+
+// Client connects to a Server with a resumable session.
+// When the connection breaks, the client reconnects according to the Backoff configuration,
+// and resumes the session.
+type Client struct {
+	// Client is used to connect to the server.
+	// The default, if not set, is the default client configuration.
+	Client *h2conn.Client
+	// URL is the URL of the server.
+	URL string
+	// Backoff configures the delays between reconnection attempts.
+	Backoff h2conn.Backoff
+	// MaxBuffer is the maximal size of the replay buffer, and of the received data that was
+	// not read.
+	// The default, if not set, is DefaultMaxBuffer.
+	MaxBuffer int
+}
+
+// Connect starts a new session with the server.
+// The first connection attempt is not retried, and its error is returned. The context bounds
+// the lifetime of the session, and the session fails with the context error when it is done.
+func (c *Client) Connect(ctx context.Context) (*Session, error) {
+	conn, resp, err := c.connect(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	id := resp.Header.Get(sessionIDHeader)
+	if id == "" {
+		conn.Close()
+		return nil, fmt.Errorf("resume: server did not respond with a session ID")
+	}
+
+	s := newSession(id, c.MaxBuffer)
+	s.onDetach = func(error) { go c.reconnect(ctx, s) }
+	if err := s.attach(conn); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reconnect connects to the server until the session is resumed or done.
+func (c *Client) reconnect(ctx context.Context, s *Session) {
+	for attempt := 0; ; attempt++ {
+		t := time.NewTimer(c.Backoff.Delay(attempt))
+		select {
+		case <-t.C:
+		case <-s.Done():
+			t.Stop()
+			return
+		case <-ctx.Done():
+			t.Stop()
+			s.fail(ctx.Err())
+			return
+		}
+
+		conn, _, err := c.connect(ctx, s.id)
+		if err == ErrSessionExpired {
+			s.fail(err)
+			return
+		}
+		if err != nil {
+			continue
+		}
+		// The server closes the connection of another principal with a close error.
+		err = s.attach(conn)
+		var closeErr *h2conn.CloseError
+		if errors.As(err, &closeErr) && closeErr.Code == closeForbidden {
+			s.fail(ErrSessionForbidden)
+			return
+		}
+		if err == nil || isClosed(s.Done()) {
+			return
+		}
+	}
+}
+
+// connect connects to the server, presenting the session ID if it is not empty.
+func (c *Client) connect(ctx context.Context, id string) (*h2conn.Conn, *http.Response, error) {
+	var cl h2conn.Client
+	if c.Client != nil {
+		cl = *c.Client
+	}
+	if id != "" {
+		cl.Header = cl.Header.Clone()
+		if cl.Header == nil {
+			cl.Header = http.Header{}
+		}
+		cl.Header.Set(sessionIDHeader, id)
+	}
+
+	conn, resp, err := cl.Connect(ctx, c.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound && id != "":
+		conn.Close()
+		return nil, nil, ErrSessionExpired
+	case resp.StatusCode != http.StatusOK:
+		conn.Close()
+		return nil, nil, fmt.Errorf("resume: bad status code %d", resp.StatusCode)
+	}
+	return conn, resp, nil
+}
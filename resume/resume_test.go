@@ -0,0 +1,273 @@
+package resume
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/posener/h2conn"
+	"github.com/posener/h2conn/h2test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+// breaker dials TLS connections, and can break all of them to simulate a network change.
+type breaker struct {
+	mu    sync.Mutex
+	conns []net.Conn
+	dials int
+}
+
+func (b *breaker) client() *h2conn.Client {
+	return &h2conn.Client{Client: &http.Client{Transport: &http2.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := (&tls.Dialer{Config: cfg}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			b.mu.Lock()
+			b.conns = append(b.conns, conn)
+			b.dials++
+			b.mu.Unlock()
+			return conn, nil
+		},
+	}}}
+}
+
+func (b *breaker) breakAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+	b.conns = nil
+}
+
+// TestResume tests that a session survives breaking connections without losing data.
+func TestResume(t *testing.T) {
+	t.Parallel()
+
+	const numLines = 3000
+
+	srv := &Server{}
+	defer srv.Close()
+	server := h2test.NewServer(srv)
+	defer server.Close()
+
+	// Echo the data of every session.
+	go func() {
+		for {
+			s, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer s.Close()
+				io.Copy(s, s)
+			}()
+		}
+	}()
+
+	var b breaker
+	c := &Client{Client: b.client(), URL: server.URL, Backoff: h2conn.Backoff{Initial: time.Millisecond}}
+	s, err := c.Connect(context.Background())
+	require.NoError(t, err)
+	defer s.Close()
+
+	// The writer is limited to be ahead of the reader, such that data is in flight when
+	// the connections break.
+	ahead := make(chan struct{}, 50)
+	go func() {
+		for i := 0; i < numLines; i++ {
+			ahead <- struct{}{}
+			_, err := fmt.Fprintf(s, "line %d\n", i)
+			if err != nil {
+				t.Errorf("write failed: %s", err)
+				return
+			}
+		}
+	}()
+
+	buf := bufio.NewReader(s)
+	for i := 0; i < numLines; i++ {
+		if i == numLines/3 || i == 2*numLines/3 {
+			b.breakAll()
+		}
+		line, err := buf.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("line %d\n", i), line)
+		<-ahead
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	assert.Equal(t, 3, b.dials)
+}
+
+// TestResumeExpired tests that a session that is not resumed in time fails.
+func TestResumeExpired(t *testing.T) {
+	t.Parallel()
+
+	srv := &Server{ResumeTimeout: time.Millisecond}
+	defer srv.Close()
+	server := h2test.NewServer(srv)
+	defer server.Close()
+
+	go func() {
+		s, err := srv.Accept()
+		if err != nil {
+			return
+		}
+		<-s.Done()
+	}()
+
+	var b breaker
+	c := &Client{Client: b.client(), URL: server.URL, Backoff: h2conn.Backoff{Initial: 100 * time.Millisecond}}
+	s, err := c.Connect(context.Background())
+	require.NoError(t, err)
+	defer s.Close()
+
+	b.breakAll()
+	_, err = s.Read(make([]byte, 1))
+	assert.Equal(t, ErrSessionExpired, err)
+}
+
+// TestClose tests that closing a session ends the other side after all data was sent.
+func TestClose(t *testing.T) {
+	t.Parallel()
+
+	srv := &Server{}
+	defer srv.Close()
+	server := h2test.NewServer(srv)
+	defer server.Close()
+
+	got := make(chan string, 1)
+	go func() {
+		s, err := srv.Accept()
+		if err != nil {
+			return
+		}
+		data, err := io.ReadAll(s)
+		assert.NoError(t, err)
+		got <- string(data)
+	}()
+
+	var b breaker
+	c := &Client{Client: b.client(), URL: server.URL}
+	s, err := c.Connect(context.Background())
+	require.NoError(t, err)
+	_, err = s.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	assert.Equal(t, "hello", <-got)
+
+	_, err = s.Write([]byte("hello"))
+	assert.Error(t, err)
+}
+
+// TestCloseResumed tests that a session that is closed while its connection breaks is resumed
+// until the other side received all the data and the close.
+func TestCloseResumed(t *testing.T) {
+	t.Parallel()
+
+	srv := &Server{}
+	defer srv.Close()
+	server := h2test.NewServer(srv)
+	defer server.Close()
+
+	got := make(chan []byte, 1)
+	go func() {
+		s, err := srv.Accept()
+		if err != nil {
+			return
+		}
+		data, err := io.ReadAll(s)
+		assert.NoError(t, err)
+		got <- data
+	}()
+
+	var b breaker
+	c := &Client{Client: b.client(), URL: server.URL, Backoff: h2conn.Backoff{Initial: time.Millisecond}}
+	s, err := c.Connect(context.Background())
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 16<<10)
+	_, err = s.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	// Break the connection while the data is in flight.
+	b.breakAll()
+
+	select {
+	case d := <-got:
+		assert.Equal(t, len(data), len(d))
+		assert.True(t, bytes.Equal(data, d))
+	case <-time.After(5 * time.Second):
+		t.Fatal("data was not received")
+	}
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("close was not acknowledged")
+	}
+}
+
+// TestResumeOtherPrincipal tests that a session can not be resumed by another principal.
+func TestResumeOtherPrincipal(t *testing.T) {
+	t.Parallel()
+
+	auth := &h2conn.BasicAuth{Users: map[string]string{"alice": "a", "bob": "b"}}
+	srv := &Server{Server: &h2conn.Server{Authenticator: auth}}
+	defer srv.Close()
+	server := h2test.NewServer(srv)
+	defer server.Close()
+
+	go func() {
+		s, err := srv.Accept()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		io.Copy(s, s)
+	}()
+
+	var b breaker
+	alice := b.client()
+	alice.Header = http.Header{"Authorization": []string{basicAuth("alice", "a")}}
+	c := &Client{Client: alice, URL: server.URL, Backoff: h2conn.Backoff{Initial: time.Millisecond}}
+	s, err := c.Connect(context.Background())
+	require.NoError(t, err)
+	defer s.Close()
+
+	bob := b.client()
+	bob.Header = http.Header{"Authorization": []string{basicAuth("bob", "b")}}
+	bobClient := &Client{Client: bob, URL: server.URL, Backoff: h2conn.Backoff{Initial: time.Millisecond}}
+	bobSession := newSession(s.ID(), 0)
+	bobClient.reconnect(context.Background(), bobSession)
+	_, err = bobSession.Read(make([]byte, 1))
+	assert.Equal(t, ErrSessionForbidden, err)
+
+	// The session of alice is not affected.
+	_, err = s.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(s, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func basicAuth(username, password string) string {
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth(username, password)
+	return r.Header.Get("Authorization")
+}
@@ -0,0 +1,213 @@
+package resume
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/posener/h2conn"
+)
+
+// DefaultResumeTimeout is the resume timeout if the Server has no ResumeTimeout set.
+const DefaultResumeTimeout = time.Minute
+
+// Server is an http.Handler that accepts resumable sessions.
+// New sessions are returned by the Accept method. Requests that resume an existing session
+// are attached to it, if they are authenticated with the principal that opened the session.
+// The http handler blocks until its connection is detached.
+//
+// Usage:
+//
+//      server := &resume.Server{}
+//      go func() {
+//          for {
+//              session, err := server.Accept()
+//              if err != nil {
+//                  return
+//              }
+//              go handle(session)
+//          }
+//      }()
+//      http.ListenAndServeTLS(":8443", "cert.pem", "key.pem", server)
+//
+type Server struct {
+	// Server is used to accept the connections.
+	// The default, if not set, is the default server configuration.
+	Server *h2conn.Server
+	// MaxBuffer is the maximal size of the replay buffer, and of the received data that was
+	// not read, of each session.
+	// The default, if not set, is DefaultMaxBuffer.
+	MaxBuffer int
+	// ResumeTimeout is the time that a session waits for the client to resume it after the
+	// connection breaks. After the timeout the session fails with ErrSessionExpired.
+	// The default, if not set, is DefaultResumeTimeout.
+	ResumeTimeout time.Duration
+
+	initOnce  sync.Once
+	mu        sync.Mutex
+	sessions  map[string]*Session
+	accept    chan *Session
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (srv *Server) init() {
+	srv.initOnce.Do(func() {
+		srv.sessions = make(map[string]*Session)
+		srv.accept = make(chan *Session)
+		srv.closed = make(chan struct{})
+	})
+}
+
+// ServeHTTP accepts a new session, or resumes an existing session, and waits until the
+// connection is detached from the session.
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.init()
+
+	id := r.Header.Get(sessionIDHeader)
+	if id == "" {
+		srv.serveNew(w, r)
+		return
+	}
+
+	srv.mu.Lock()
+	s := srv.sessions[id]
+	srv.mu.Unlock()
+	if s == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	conn, err := srv.acceptConn(w, r)
+	if err != nil {
+		return
+	}
+	// The principal is known only after Accept authenticated the request, so another
+	// principal is rejected with a close error.
+	if !reflect.DeepEqual(conn.Principal(), s.principal) {
+		conn.CloseWithError(closeForbidden, "session belongs to another principal")
+		return
+	}
+	if err := s.attach(conn); err != nil {
+		return
+	}
+
+	// The request context is done after the connection is closed.
+	<-r.Context().Done()
+}
+
+func (srv *Server) serveNew(w http.ResponseWriter, r *http.Request) {
+	if isClosed(srv.closed) {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	id, err := newID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s := newSession(id, srv.MaxBuffer)
+	s.onDetach = func(error) { srv.expire(s) }
+	s.onDone = func() { srv.remove(id) }
+
+	w.Header().Set(sessionIDHeader, id)
+	conn, err := srv.acceptConn(w, r)
+	if err != nil {
+		return
+	}
+	s.principal = conn.Principal()
+	srv.mu.Lock()
+	srv.sessions[id] = s
+	srv.mu.Unlock()
+	if err := s.attach(conn); err != nil {
+		// The client might have completed the handshake before the connection broke, so
+		// the session is kept for the client to resume it.
+		srv.expire(s)
+	}
+
+	// A session that was closed by the client is still accepted, such that its data is read.
+	select {
+	case srv.accept <- s:
+	case <-srv.closed:
+		s.Close()
+	case <-s.failed:
+	}
+
+	// The request context is done after the connection is closed.
+	<-r.Context().Done()
+}
+
+// acceptConn accepts the connection of a request, and responds if Accept failed without
+// responding.
+func (srv *Server) acceptConn(w http.ResponseWriter, r *http.Request) (*h2conn.Conn, error) {
+	conn, err := srv.server().Accept(w, r)
+	if errors.Is(err, h2conn.ErrHTTP2NotSupported) {
+		http.Error(w, err.Error(), http.StatusHTTPVersionNotSupported)
+	}
+	return conn, err
+}
+
+// expire fails a detached session if it is not resumed within the resume timeout.
+func (srv *Server) expire(s *Session) {
+	timeout := srv.ResumeTimeout
+	if timeout <= 0 {
+		timeout = DefaultResumeTimeout
+	}
+	s.mu.Lock()
+	gen := s.gen
+	s.mu.Unlock()
+	time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.gen == gen && s.conn == nil {
+			s.failLocked(ErrSessionExpired)
+		}
+	})
+}
+
+func (srv *Server) remove(id string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.sessions, id)
+}
+
+func (srv *Server) server() *h2conn.Server {
+	if srv.Server != nil {
+		return srv.Server
+	}
+	return &h2conn.Server{}
+}
+
+// Accept waits for and returns the next new session.
+// It returns net.ErrClosed after the server is closed.
+func (srv *Server) Accept() (*Session, error) {
+	srv.init()
+	select {
+	case s := <-srv.accept:
+		return s, nil
+	case <-srv.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting new sessions.
+// Existing sessions are not closed, and can still be resumed.
+func (srv *Server) Close() error {
+	srv.init()
+	srv.closeOnce.Do(func() {
+		close(srv.closed)
+	})
+	return nil
+}
+
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
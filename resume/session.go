@@ -0,0 +1,474 @@
+// Package resume provides sessions that survive the breaking of the underlying connection.
+//
+// A session is a logical stream of bytes between a client and a server, which is carried
+// over an h2conn.Conn. Both sides number the bytes that they send, and keep the sent data
+// that was not acknowledged by the other side in a replay buffer. When the connection
+// breaks, for example when a mobile client switches networks, the client connects again and
+// presents the session ID. The server then attaches the new connection to the existing
+// session, and both sides retransmit the data from the last offset that the other side
+// received, such that no data is lost or duplicated.
+package resume
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/posener/h2conn"
+	"github.com/posener/h2conn/framing"
+)
+
+var (
+	// ErrSessionExpired is returned when the server no longer has the session, for example
+	// when the client did not resume it in time.
+	ErrSessionExpired = errors.New("resume: session expired")
+	// ErrSessionLost is returned when the other side of the session is missing data that
+	// is no longer in the replay buffer.
+	ErrSessionLost = errors.New("resume: session data lost")
+	// ErrSessionForbidden is returned when the server rejected resuming the session, for
+	// example because the client is not the principal that opened it.
+	ErrSessionForbidden = errors.New("resume: session forbidden")
+)
+
+// closeForbidden is the close code of a connection that tried to resume the session of
+// another principal.
+const closeForbidden uint32 = 403
+
+// DefaultMaxBuffer is the maximal buffer size if no MaxBuffer is set.
+const DefaultMaxBuffer = 1 << 20
+
+// sessionIDHeader is the header in which the server sends the ID of a new session, and in
+// which the client presents the ID of a session that it resumes.
+const sessionIDHeader = "H2conn-Session-Id"
+
+// maxChunkSize is the maximal size of data in a single message.
+const maxChunkSize = 16 * 1024
+
+// Message types. Each message is a framing message that starts with its type.
+const (
+	// msgHello starts a connection, with the offset of the received data.
+	msgHello byte = iota
+	// msgData carries data.
+	msgData
+	// msgAck acknowledges the received data, with the offset of the received data.
+	msgAck
+	// msgClose closes the session, after all the data was sent.
+	msgClose
+	// msgCloseAck acknowledges that msgClose, and all the data before it, was received.
+	msgCloseAck
+)
+
+// Session is a resumable logical stream of bytes.
+// It is safe to call Read and Write concurrently.
+type Session struct {
+	id        string
+	maxBuffer int
+	// principal is the principal of the client that opened the session, on the server side.
+	principal interface{}
+
+	// onDetach is called when the connection breaks and the session is not done.
+	onDetach func(err error)
+	// onDone is called once when the session is done.
+	onDone func()
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	conn *h2conn.Conn
+	// gen is increased when a connection is attached or detached, such that loops of a
+	// previous connection stop.
+	gen int
+
+	// sendBuf holds the sent data that was not acknowledged, which starts at offset sendBase.
+	sendBuf  []byte
+	sendBase uint64
+
+	// recvBuf holds received data that was not read. recvOffset is the offset of the received
+	// data, and ackSent is the offset that was acknowledged to the other side.
+	recvBuf    bytes.Buffer
+	recvOffset uint64
+	ackSent    uint64
+
+	// closed is set by Close. The session stays resumable until closeAcked is set, when the
+	// other side acknowledged the close.
+	closed     bool
+	closeAcked bool
+	// remoteClosed is set when the other side closed the session. The session stays
+	// resumable until closeAckSent is set, when the acknowledgement was written.
+	remoteClosed bool
+	closeAckSent bool
+	err          error
+
+	done     chan struct{}
+	doneOnce sync.Once
+	// failed is closed when the session fails.
+	failed chan struct{}
+}
+
+func newSession(id string, maxBuffer int) *Session {
+	if maxBuffer <= 0 {
+		maxBuffer = DefaultMaxBuffer
+	}
+	s := &Session{
+		id:        id,
+		maxBuffer: maxBuffer,
+		done:      make(chan struct{}),
+		failed:    make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// ID returns the session ID.
+func (s *Session) ID() string {
+	return s.id
+}
+
+// Done returns a channel that is closed when the session is closed by either side, or failed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Read reads data from the session.
+// It returns io.EOF after the other side closed the session and all data was read.
+func (s *Session) Read(data []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.closed {
+			return 0, net.ErrClosed
+		}
+		if s.recvBuf.Len() > 0 {
+			n, _ := s.recvBuf.Read(data)
+			s.cond.Broadcast()
+			return n, nil
+		}
+		switch {
+		case s.remoteClosed:
+			return 0, io.EOF
+		case s.err != nil:
+			return 0, s.err
+		case len(data) == 0:
+			return 0, nil
+		}
+		s.cond.Wait()
+	}
+}
+
+// Write writes data to the session.
+// It returns when the data is in the replay buffer, and blocks while the replay buffer is full.
+func (s *Session) Write(data []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	written := 0
+	for written < len(data) {
+		switch {
+		case s.closed || s.remoteClosed:
+			return written, net.ErrClosed
+		case s.err != nil:
+			return written, s.err
+		}
+		space := s.maxBuffer - len(s.sendBuf)
+		if space <= 0 {
+			s.cond.Wait()
+			continue
+		}
+		n := len(data) - written
+		if n > space {
+			n = space
+		}
+		s.sendBuf = append(s.sendBuf, data[written:written+n]...)
+		written += n
+		s.cond.Broadcast()
+	}
+	return written, nil
+}
+
+// Close closes the session.
+// Data in the replay buffer is sent before the other side is notified. The session is resumed
+// if the connection breaks before the other side acknowledged the close, such that no data
+// is lost, and Done is closed after the acknowledgement. Read and Write return net.ErrClosed
+// after Close.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+	return nil
+}
+
+// fail fails the session with an error.
+func (s *Session) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failLocked(err)
+}
+
+func (s *Session) failLocked(err error) {
+	if s.err == nil {
+		s.err = err
+		close(s.failed)
+	}
+	s.detachLocked()
+	s.cond.Broadcast()
+	s.finish()
+}
+
+// finish marks the session as done.
+func (s *Session) finish() {
+	s.doneOnce.Do(func() {
+		close(s.done)
+		if s.onDone != nil {
+			go s.onDone()
+		}
+	})
+}
+
+// isDone returns true if the session should not be resumed.
+// It should be called with the lock held.
+func (s *Session) isDone() bool {
+	return s.closeAcked || s.closeAckSent || s.err != nil
+}
+
+// attach attaches a connection to the session, and retransmits the data that the other side
+// did not receive.
+func (s *Session) attach(conn *h2conn.Conn) error {
+	s.mu.Lock()
+	if s.isDone() {
+		s.mu.Unlock()
+		conn.Close()
+		return net.ErrClosed
+	}
+	// Detach a previous connection, such that the received offset does not change during
+	// the handshake.
+	s.detachLocked()
+	gen := s.gen
+	offset := s.recvOffset
+	s.mu.Unlock()
+
+	framer := framing.NewFramer(conn)
+	peerOffset, err := handshake(framer, offset)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if gen != s.gen || s.isDone() {
+		conn.Close()
+		return net.ErrClosed
+	}
+	if err := s.ack(peerOffset); err != nil {
+		conn.Close()
+		s.failLocked(err)
+		return err
+	}
+	s.gen++
+	s.conn = conn
+	s.ackSent = offset
+	s.cond.Broadcast()
+	go s.recvLoop(framer, s.gen)
+	go s.sendLoop(framer, s.gen, peerOffset)
+	return nil
+}
+
+// handshake exchanges the received offsets with the other side.
+// The message of the other side is read also if the write failed, such that a close error of
+// the server, which rejected the connection, is returned.
+func handshake(framer *framing.Framer, offset uint64) (uint64, error) {
+	werr := framer.WriteMessage(binary.BigEndian.AppendUint64([]byte{msgHello}, offset))
+	msg, err := framer.ReadMessage()
+	if err != nil {
+		return 0, err
+	}
+	if werr != nil {
+		return 0, werr
+	}
+	if len(msg) != 9 || msg[0] != msgHello {
+		return 0, fmt.Errorf("resume: invalid handshake message")
+	}
+	return binary.BigEndian.Uint64(msg[1:]), nil
+}
+
+// detach detaches the connection of the given generation after it broke.
+func (s *Session) detach(gen int, err error) {
+	s.mu.Lock()
+	if gen != s.gen || s.conn == nil {
+		s.mu.Unlock()
+		return
+	}
+	s.detachLocked()
+	done := s.isDone()
+	s.mu.Unlock()
+	if !done && s.onDetach != nil {
+		s.onDetach(err)
+	}
+}
+
+func (s *Session) detachLocked() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	s.gen++
+	s.cond.Broadcast()
+}
+
+// ack removes the data that the other side received from the replay buffer.
+// It should be called with the lock held.
+func (s *Session) ack(offset uint64) error {
+	if offset < s.sendBase || offset > s.sendBase+uint64(len(s.sendBuf)) {
+		return ErrSessionLost
+	}
+	n := offset - s.sendBase
+	s.sendBuf = append(s.sendBuf[:0], s.sendBuf[n:]...)
+	s.sendBase = offset
+	s.cond.Broadcast()
+	return nil
+}
+
+// recvLoop reads messages from a connection.
+func (s *Session) recvLoop(framer *framing.Framer, gen int) {
+	for {
+		msg, err := framer.ReadMessage()
+		if err != nil {
+			s.detach(gen, err)
+			return
+		}
+		if len(msg) == 0 {
+			s.detach(gen, fmt.Errorf("resume: empty message"))
+			return
+		}
+
+		s.mu.Lock()
+		for msg[0] == msgData && s.recvBuf.Len() >= s.maxBuffer && gen == s.gen && !s.closed {
+			s.cond.Wait()
+		}
+		if gen != s.gen {
+			s.mu.Unlock()
+			return
+		}
+		switch msg[0] {
+		case msgData:
+			if !s.closed {
+				s.recvBuf.Write(msg[1:])
+			}
+			s.recvOffset += uint64(len(msg) - 1)
+		case msgAck:
+			if len(msg) != 9 {
+				err = fmt.Errorf("resume: invalid ack message")
+			} else if err = s.ack(binary.BigEndian.Uint64(msg[1:])); err != nil {
+				s.failLocked(err)
+			}
+		case msgClose:
+			s.remoteClosed = true
+		case msgCloseAck:
+			s.closeAcked = true
+			s.detachLocked()
+			s.finish()
+		default:
+			err = fmt.Errorf("resume: unknown message type %d", msg[0])
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		if err != nil {
+			s.detach(gen, err)
+			return
+		}
+		switch msg[0] {
+		case msgClose:
+			// All the data was received, so the other side can finish. The session is done
+			// only after the acknowledgement was written, otherwise the other side resumes
+			// it and closes it again.
+			if err := framer.WriteMessage([]byte{msgCloseAck}); err != nil {
+				s.detach(gen, err)
+				return
+			}
+			s.mu.Lock()
+			s.closeAckSent = true
+			if gen == s.gen {
+				s.detachLocked()
+			}
+			s.finish()
+			s.mu.Unlock()
+			return
+		case msgCloseAck:
+			return
+		}
+	}
+}
+
+// sendLoop sends data and acknowledgements on a connection, starting from the given offset.
+func (s *Session) sendLoop(framer *framing.Framer, gen int, next uint64) {
+	var msg []byte
+	for {
+		s.mu.Lock()
+		var ack, data, closing bool
+		for {
+			if gen != s.gen || s.err != nil || s.remoteClosed {
+				s.mu.Unlock()
+				return
+			}
+			ack = s.recvOffset > s.ackSent
+			data = s.sendBase+uint64(len(s.sendBuf)) > next
+			closing = s.closed && !data
+			if ack || data || closing {
+				break
+			}
+			s.cond.Wait()
+		}
+
+		var ackMsg []byte
+		if ack {
+			s.ackSent = s.recvOffset
+			ackMsg = binary.BigEndian.AppendUint64([]byte{msgAck}, s.ackSent)
+		}
+		msg = msg[:0]
+		if data {
+			start := next - s.sendBase
+			end := start + maxChunkSize
+			if end > uint64(len(s.sendBuf)) {
+				end = uint64(len(s.sendBuf))
+			}
+			msg = append(append(msg, msgData), s.sendBuf[start:end]...)
+		}
+		s.mu.Unlock()
+
+		if ack {
+			if err := framer.WriteMessage(ackMsg); err != nil {
+				s.detach(gen, err)
+				return
+			}
+		}
+		if closing {
+			// The connection is closed when the other side acknowledges the close. If it
+			// breaks before, the session is resumed and the close is sent again.
+			if err := framer.WriteMessage([]byte{msgClose}); err != nil {
+				s.detach(gen, err)
+			}
+			return
+		}
+		if data {
+			if err := framer.WriteMessage(msg); err != nil {
+				s.detach(gen, err)
+				return
+			}
+			next += uint64(len(msg) - 1)
+		}
+	}
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating session ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
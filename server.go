@@ -1,45 +1,233 @@
 package h2conn
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // ErrHTTP2NotSupported is returned by Accept if the client connection does not
-// support HTTP2 connection.
+// support HTTP2 connection, and HTTP1.1 full duplex was not allowed or is not supported.
 // The server than can response to the client with an HTTP1.1 as he wishes.
+// It is also returned by Connect if the server responded with HTTP1.1, and the client
+// does not allow it.
 var ErrHTTP2NotSupported = fmt.Errorf("HTTP2 not supported")
 
 // Server can "accept" an http2 connection to obtain a read/write object
 // for full duplex communication with a client.
 type Server struct {
+	// StatusCode is the status code of the response.
+	// The default, if not set, is http.StatusOK.
 	StatusCode int
+	// Header is added to the response header.
+	Header http.Header
+	// Protocols are the application protocols that the server supports, in order of
+	// preference. The selected protocol is the first of them that the client supports, and
+	// is available with Conn.Protocol. If the client does not support any of them, or
+	// did not send its protocols, no protocol is selected and the connection is accepted.
+	Protocols []string
+	// AllowHTTP1 enables full duplex communication with HTTP1.1 clients, using a chunked
+	// response body that is written while the request body is read.
+	// The client should be configured with Client.AllowHTTP1.
+	AllowHTTP1 bool
+	// BufferWrites disables flushing of the response after every write to the connection.
+	// Buffered data is sent to the client when Conn.Flush is called, or according to
+	// FlushSize and FlushInterval.
+	BufferWrites bool
+	// FlushSize, if set with BufferWrites, flushes the buffered data when it reaches this
+	// number of bytes.
+	FlushSize int
+	// FlushInterval, if set with BufferWrites, flushes the buffered data this duration
+	// after the first unflushed write. The flush is done in the background, so the
+	// connection should be closed and the request context should be done before the
+	// http handler returns.
+	FlushInterval time.Duration
+	// Authenticator, if set, authenticates requests before they are accepted. Rejected
+	// requests are responded by Accept, which returns an *AuthError. The principal of
+	// accepted requests is available with Conn.Principal.
+	Authenticator Authenticator
+	// HeartbeatInterval, if set, enables in-band heartbeats when the client also enables
+	// them. A heartbeat is sent when nothing was written for this duration. If the client
+	// does not enable heartbeats, the connection is used without them. Heartbeats are sent
+	// in the background, so the connection should be closed and the request context should
+	// be done before the http handler returns.
+	HeartbeatInterval time.Duration
+	// HeartbeatTimeout is the duration in which nothing was received from the client, after
+	// which the connection is closed and its operations return ErrPeerUnresponsive. Heartbeats
+	// are received also when the connection is not read, unless data that was not read blocks
+	// them, in which case the connection is closed only if a write also made no progress.
+	// The default, if not set, is 3 times the HeartbeatInterval.
+	HeartbeatTimeout time.Duration
+	// RateLimit configures the rate limits of reads and writes of the accepted connections.
+	// The default, if not set, is no limits.
+	RateLimit RateLimit
+	// Compression, if set, enables per-message compression when the client also enables it.
+	// If the client does not enable compression, the connection is used without it.
+	Compression *Compression
+
+	// MaxConns, if set, is the maximal number of connections. Further connections are
+	// rejected with http.StatusServiceUnavailable, and Accept returns a *LimitError.
+	MaxConns int
+	// MaxConnsPerRemote, if set, is the maximal number of connections from a single remote
+	// host. Further connections are rejected with http.StatusTooManyRequests, and Accept
+	// returns a *LimitError.
+	MaxConnsPerRemote int
+	// Admit, if set, is called before a request is authenticated, and the request is
+	// rejected with http.StatusTooManyRequests if it returns false, and Accept returns a
+	// *LimitError. It can be used for rate limiting of new connections.
+	Admit func(r *http.Request) bool
+	// RetryAfter is sent in the Retry-After header of rejections by the connection limits.
+	// The default, if not set, is 1 second.
+	RetryAfter time.Duration
+
+	// Registry of the accepted connections, see Shutdown.
+	mu sync.Mutex
+	// conns maps the accepted connections to their remote host.
+	conns        map[*Conn]string
+	remotes      map[string]int
+	shuttingDown bool
+	// drained is closed when the server is shutting down and all connections were removed.
+	drained chan struct{}
 }
 
 // Accept is used on a server http.Handler to extract a full-duplex communication object with the client.
 // See h2conn.Accept documentation for more info.
 func (u *Server) Accept(w http.ResponseWriter, r *http.Request) (*Conn, error) {
-	if !r.ProtoAtLeast(2, 0) {
-		return nil, ErrHTTP2NotSupported
-	}
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		return nil, ErrHTTP2NotSupported
 	}
 
-	c, ctx := newConn(r.Context(), r.Body, &flushWrite{w: w, f: flusher})
+	var body io.ReadCloser = r.Body
+	if !r.ProtoAtLeast(2, 0) {
+		if !u.AllowHTTP1 {
+			return nil, ErrHTTP2NotSupported
+		}
+		if err := http.NewResponseController(w).EnableFullDuplex(); err != nil {
+			return nil, ErrHTTP2NotSupported
+		}
+		// Closing an HTTP1.1 request body blocks until the client is done sending. The
+		// body is closed by the server when the http handler returns.
+		body = io.NopCloser(r.Body)
+	}
+
+	if u.Admit != nil && !u.Admit(r) {
+		return nil, u.reject(w, &LimitError{Limit: "Admit", StatusCode: http.StatusTooManyRequests})
+	}
+
+	var principal interface{}
+	if u.Authenticator != nil {
+		var err error
+		if principal, err = authenticate(u.Authenticator, w, r); err != nil {
+			return nil, err
+		}
+	}
+
+	var localAddr net.Addr = addr("")
+	if a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		localAddr = a
+	}
+
+	// The connection context is canceled only after the connection is closed and the response
+	// writer is no longer used, also when the request context is done, such that the handler
+	// can safely return when it is done.
+	reqCtx := r.Context()
+	ctx, cancel := context.WithCancelCause(context.WithoutCancel(reqCtx))
+	body = &trailerReader{ReadCloser: body, trailer: func() http.Header { return r.Trailer }}
+	c := newConn(ctx, cancel, body, &flushWrite{w: w, f: flusher, buffered: u.BufferWrites}, localAddr, addr(r.RemoteAddr))
+	if err := u.register(c, remoteHost(r.RemoteAddr)); err != nil {
+		cancel(err)
+		var limitErr *LimitError
+		if errors.As(err, &limitErr) {
+			return nil, u.reject(w, limitErr)
+		}
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return nil, err
+	}
+	c.header = r.Header
+	c.noCloseWrite = true
+	c.resetStream = func() {
+		// The response writer must not be used after the handler returned, which is when the
+		// request context is done, unless the client reset the stream before.
+		if reqCtx.Err() != nil {
+			return
+		}
+		defer func() {
+			// The handler might return concurrently.
+			recover()
+		}()
+		http.NewResponseController(w).SetWriteDeadline(time.Now())
+	}
+	c.principal = principal
+	c.protocol = selectProtocol(u.Protocols, parseProtocols(r.Header))
+	c.setCloseError = func(e *CloseError) { setCloseTrailer(w.Header(), http.TrailerPrefix, e) }
+	if u.BufferWrites {
+		c.flushSize = u.FlushSize
+		c.flushInterval = u.FlushInterval
+	}
+	for k, v := range u.Header {
+		// Copy the values, such that handlers can modify the response header.
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	if c.protocol != "" {
+		w.Header().Set(protocolHeader, c.protocol)
+	}
+	peerTimeout, heartbeat := parseHeartbeat(r.Header)
+	heartbeat = heartbeat && u.HeartbeatInterval > 0
+	timeout := heartbeatTimeout(u.HeartbeatInterval, u.HeartbeatTimeout)
+	if heartbeat {
+		w.Header().Set(heartbeatHeader, timeout.String())
+	}
+	compress, contextTakeover := parseCompression(r.Header)
+	compress = compress && u.Compression != nil
+	contextTakeover = contextTakeover && compress && !u.Compression.NoContextTakeover
+	if compress {
+		w.Header().Set(compressionHeader, formatCompression(contextTakeover))
+	}
 
 	// Update the request context with the connection context.
 	// If the connection is closed by the server, it will also notify everything that waits on the request context.
 	*r = *r.WithContext(ctx)
 
-	w.WriteHeader(u.StatusCode)
+	statusCode := u.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	w.WriteHeader(statusCode)
 	flusher.Flush()
 
+	if heartbeat {
+		c.enableHeartbeat(u.HeartbeatInterval, timeout, peerTimeout)
+	}
+	c.enableRateLimit(u.RateLimit)
+	if compress {
+		c.enableCompression(u.Compression, contextTakeover)
+	}
+	context.AfterFunc(reqCtx, func() {
+		c.closeWithCause(context.Cause(reqCtx), nil)
+		u.unregister(c)
+	})
+
 	return c, nil
 }
 
+// responded returns true if Accept failed with an error after it responded to the request.
+func responded(err error) bool {
+	var (
+		authErr  *AuthError
+		limitErr *LimitError
+	)
+	return errors.As(err, &authErr) || errors.As(err, &limitErr) || err == http.ErrServerClosed
+}
+
 var defaultUpgrader = Server{
 	StatusCode: http.StatusOK,
 }
@@ -48,6 +236,11 @@ var defaultUpgrader = Server{
 // The server connection will be closed when the http handler function will return.
 // If the client does not support HTTP2, an ErrHTTP2NotSupported is returned.
 //
+// The HTTP2 stream is ended with END_STREAM when the http handler function returns, or reset
+// with RST_STREAM if the client did not finish sending. Closing the connection cancels the
+// request context, and if the handler does not return shortly after, the stream is reset, such
+// that a connection that was closed by another goroutine does not stay open on the client.
+//
 // Usage:
 //
 //      func (w http.ResponseWriter, r *http.Request) {
@@ -63,20 +256,40 @@ func Accept(w http.ResponseWriter, r *http.Request) (*Conn, error) {
 	return defaultUpgrader.Accept(w, r)
 }
 
+// flushWrite writes to the response, and flushes it after every write unless buffered.
 type flushWrite struct {
-	w io.Writer
-	f http.Flusher
+	w        io.Writer
+	f        http.Flusher
+	buffered bool
 }
 
 func (w *flushWrite) Write(data []byte) (int, error) {
 	n, err := w.w.Write(data)
-	w.f.Flush()
+	if !w.buffered {
+		w.f.Flush()
+	}
 	return n, err
 }
 
+func (w *flushWrite) Flush() error {
+	w.f.Flush()
+	return nil
+}
+
 func (w *flushWrite) Close() error {
-	// Currently server side close of connection is not supported in Go.
-	// The server closes the connection when the http.Handler function returns.
-	// We use connection context and cancel function as a work-around.
+	// The response is ended when the http.Handler function returns, or reset by the
+	// connection if the handler does not return.
 	return nil
 }
+
+// H2CHandler wraps an HTTP handler such that it serves HTTP2 over plain TCP (h2c).
+// Clients should connect with Client.Cleartext set, using an "http" URL.
+// It is useful when TLS is terminated before the server, for example by a proxy.
+//
+// Usage:
+//
+//      http.ListenAndServe(":8080", h2conn.H2CHandler(handler))
+//
+func H2CHandler(h http.Handler) http.Handler {
+	return h2c.NewHandler(h, &http2.Server{})
+}
@@ -0,0 +1,393 @@
+package h2conn
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/posener/h2conn/framing"
+)
+
+// ErrSessionClosed is returned when a session was closed.
+var ErrSessionClosed = errors.New("session closed")
+
+// sessionTokenHeader is the header in which a client sends the token of a connection that
+// was opened by the server.
+const sessionTokenHeader = "H2conn-Session-Token"
+
+// sessionOpen is a message on the control connection, which asks the client to connect to
+// the URL with the token.
+type sessionOpen struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+}
+
+// sessionFailed is a message on the control connection, which tells the server that the
+// client failed to connect with the token.
+type sessionFailed struct {
+	Token string `json:"token"`
+	Error string `json:"error"`
+}
+
+// OpenError is returned by Session.Open when the connection was rejected by the server, or
+// the client failed to connect.
+type OpenError struct {
+	Reason string
+}
+
+func (e *OpenError) Error() string {
+	return "session open failed: " + e.Reason
+}
+
+// Rendezvous enables the server to open connections toward clients.
+// A client opens a session with Client.Session, which is accepted on the server with the
+// Accept method. The server can then open connections with Session.Open: it asks the client
+// to connect to the rendezvous URL, which is handled by the ServeHTTP method.
+//
+// Usage:
+//
+//      rv := &h2conn.Rendezvous{URL: "/rendezvous"}
+//      http.Handle("/rendezvous", rv)
+//      http.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+//          session, err := rv.Accept(w, r)
+//          if err != nil {
+//              log.Printf("Failed creating session: %s", err)
+//              return
+//          }
+//          defer session.Close()
+//          conn, err := session.Open(r.Context())
+//          // use conn
+//      })
+//
+type Rendezvous struct {
+	// Server is used to accept the session and the rendezvous connections.
+	// The default, if not set, is the default server configuration.
+	Server *Server
+	// URL is the rendezvous URL that clients connect to when the server opens a connection.
+	// A relative URL is resolved against the session URL. Clients send the headers of the
+	// session, which might include credentials, to this URL, so they refuse to connect to a
+	// URL with a different scheme or host than the session URL.
+	URL string
+
+	mu      sync.Mutex
+	pending map[string]*pendingOpen
+}
+
+// pendingOpen is a connection that was opened by the server, and waits for the client.
+type pendingOpen struct {
+	session *Session
+	conns   chan *Conn
+	// errs gets the first failure of the connection.
+	errs chan error
+	done chan struct{}
+}
+
+// fail fails the pending Open, unless it already failed.
+func (p *pendingOpen) fail(err error) {
+	select {
+	case p.errs <- err:
+	default:
+	}
+}
+
+// Accept accepts a session from a client.
+// The session is closed when the http handler returns, so the handler should not return
+// before the session is done.
+func (rv *Rendezvous) Accept(w http.ResponseWriter, r *http.Request) (*Session, error) {
+	conn, err := rv.server().Accept(w, r)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		rv:     rv,
+		conn:   conn,
+		framer: framing.NewFramer(conn),
+		done:   make(chan struct{}),
+	}
+	go s.watch()
+	return s, nil
+}
+
+// ServeHTTP handles the rendezvous requests of clients, and waits until the connection is closed.
+func (rv *Rendezvous) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get(sessionTokenHeader)
+	rv.mu.Lock()
+	p := rv.pending[token]
+	rv.mu.Unlock()
+	if p == nil {
+		http.Error(w, "unknown session token", http.StatusNotFound)
+		return
+	}
+
+	conn, err := rv.server().Accept(w, r)
+	if err != nil {
+		if !responded(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		// Fail the Open, which would otherwise wait for a connection that will not come.
+		p.fail(&OpenError{Reason: err.Error()})
+		return
+	}
+	// The token is used once, so it is removed only after the connection was accepted.
+	rv.mu.Lock()
+	claimed := rv.pending[token] == p
+	if claimed {
+		delete(rv.pending, token)
+	}
+	rv.mu.Unlock()
+	if !claimed {
+		conn.Close()
+		return
+	}
+	select {
+	case p.conns <- conn:
+	case <-p.done:
+		conn.Close()
+	}
+
+	// The request context is done after the connection is closed.
+	<-r.Context().Done()
+}
+
+func (rv *Rendezvous) server() *Server {
+	if rv.Server != nil {
+		return rv.Server
+	}
+	return &defaultUpgrader
+}
+
+func (rv *Rendezvous) register(token string, p *pendingOpen) {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	if rv.pending == nil {
+		rv.pending = make(map[string]*pendingOpen)
+	}
+	rv.pending[token] = p
+}
+
+func (rv *Rendezvous) unregister(token string) {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	delete(rv.pending, token)
+}
+
+// Session is the server side of a session, which is used to open connections toward the client.
+type Session struct {
+	rv     *Rendezvous
+	conn   *Conn
+	framer *framing.Framer
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Open opens a new connection toward the client.
+// It asks the client to connect to the rendezvous URL, and waits until the connection is
+// accepted or the context is done. It returns an *OpenError if the connection was rejected by
+// the server, or the client failed to connect.
+func (s *Session) Open(ctx context.Context) (*Conn, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	p := &pendingOpen{session: s, conns: make(chan *Conn), errs: make(chan error, 1), done: make(chan struct{})}
+	s.rv.register(token, p)
+	defer func() {
+		s.rv.unregister(token)
+		close(p.done)
+	}()
+
+	msg, err := json.Marshal(sessionOpen{URL: s.rv.URL, Token: token})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.framer.WriteMessage(msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case conn := <-p.conns:
+		return conn, nil
+	case err := <-p.errs:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.done:
+		return nil, ErrSessionClosed
+	}
+}
+
+// Done returns a channel that is closed when the session is closed by either side.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close closes the session.
+// Connections that were opened by the session are not closed.
+func (s *Session) Close() error {
+	err := s.conn.Close()
+	s.closeOnce.Do(func() { close(s.done) })
+	return err
+}
+
+// watch handles the messages of the client on the control connection, and closes the session
+// when the client closes it.
+func (s *Session) watch() {
+	defer s.Close()
+	for {
+		data, err := s.framer.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg sessionFailed
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return
+		}
+		s.rv.mu.Lock()
+		p := s.rv.pending[msg.Token]
+		s.rv.mu.Unlock()
+		// A client can only fail the connections of its own session.
+		if p != nil && p.session == s {
+			p.fail(&OpenError{Reason: msg.Error})
+		}
+	}
+}
+
+// ClientSession is the client side of a session, which accepts connections that are opened
+// by the server.
+type ClientSession struct {
+	client *Client
+	ctx    context.Context
+	url    *url.URL
+	conn   *Conn
+	framer *framing.Framer
+	conns  chan *Conn
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Session opens a session with a server that accepts it with Rendezvous.Accept.
+// The context bounds the session and the connections that are opened by the server.
+func (c *Client) Session(ctx context.Context, urlStr string) (*ClientSession, *http.Response, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, resp, err := c.Connect(ctx, urlStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &ClientSession{
+		client: c,
+		ctx:    ctx,
+		url:    u,
+		conn:   conn,
+		framer: framing.NewFramer(conn),
+		conns:  make(chan *Conn),
+		done:   make(chan struct{}),
+	}
+	go s.recv()
+	return s, resp, nil
+}
+
+// Accept waits for and returns the next connection that is opened by the server.
+func (s *ClientSession) Accept(ctx context.Context) (*Conn, error) {
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.done:
+		return nil, ErrSessionClosed
+	}
+}
+
+// Done returns a channel that is closed when the session is closed by either side.
+func (s *ClientSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close closes the session.
+// Connections that were opened by the session are not closed.
+func (s *ClientSession) Close() error {
+	err := s.conn.Close()
+	s.closeOnce.Do(func() { close(s.done) })
+	return err
+}
+
+// recv handles the messages of the server on the control connection.
+func (s *ClientSession) recv() {
+	defer s.Close()
+	for {
+		data, err := s.framer.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg sessionOpen
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return
+		}
+		go s.connect(msg)
+	}
+}
+
+// connect connects to the rendezvous URL, and passes the connection to Accept. Failures are
+// reported to the server, such that its Open does not wait for the connection.
+func (s *ClientSession) connect(msg sessionOpen) {
+	conn, err := s.dial(msg)
+	if err != nil {
+		if data, err := json.Marshal(sessionFailed{Token: msg.Token, Error: err.Error()}); err == nil {
+			s.framer.WriteMessage(data)
+		}
+		return
+	}
+	select {
+	case s.conns <- conn:
+	case <-s.done:
+		conn.Close()
+	}
+}
+
+// dial connects to the rendezvous URL with the token.
+func (s *ClientSession) dial(msg sessionOpen) (*Conn, error) {
+	ref, err := url.Parse(msg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rendezvous URL: %w", err)
+	}
+	u := s.url.ResolveReference(ref)
+	// The headers of the client might include credentials, which are not sent to other hosts.
+	if u.Scheme != s.url.Scheme || u.Host != s.url.Host {
+		return nil, fmt.Errorf("rendezvous URL %q is not on the session host", msg.URL)
+	}
+	cl := *s.client
+	cl.Header = cl.Header.Clone()
+	if cl.Header == nil {
+		cl.Header = http.Header{}
+	}
+	cl.Header.Set(sessionTokenHeader, msg.Token)
+
+	conn, resp, err := cl.Connect(s.ctx, u.String())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("rendezvous status: %s", resp.Status)
+	}
+	return conn, nil
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,131 @@
+package h2conn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/posener/h2conn/h2test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSession tests connections that are opened by the server.
+func TestSession(t *testing.T) {
+	t.Parallel()
+
+	const numConns = 3
+
+	rv := &Rendezvous{URL: "/rendezvous"}
+	sessionDone := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.Handle("/rendezvous", rv)
+	mux.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+		defer close(sessionDone)
+		session, err := rv.Accept(w, r)
+		require.NoError(t, err)
+		defer session.Close()
+
+		for i := 0; i < numConns; i++ {
+			conn, err := session.Open(r.Context())
+			require.NoError(t, err)
+			_, err = fmt.Fprintf(conn, "hello %d", i)
+			require.NoError(t, err)
+			require.NoError(t, conn.Close())
+		}
+		<-session.Done()
+	})
+	server := h2test.NewServer(mux)
+	defer server.Close()
+
+	session, resp, err := insecureClient.Session(context.Background(), server.URL+"/session")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for i := 0; i < numConns; i++ {
+		conn, err := session.Accept(context.Background())
+		require.NoError(t, err)
+		got, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("hello %d", i), string(got))
+		conn.Close()
+	}
+
+	require.NoError(t, session.Close())
+	<-sessionDone
+	_, err = session.Accept(context.Background())
+	assert.Equal(t, ErrSessionClosed, err)
+}
+
+// TestSessionOpenFailed tests that Open fails when the client fails to connect.
+func TestSessionOpenFailed(t *testing.T) {
+	t.Parallel()
+
+	// rejectRendezvous rejects the rendezvous requests, and accepts the session.
+	rejectRendezvous := AuthenticatorFunc(func(r *http.Request) (interface{}, error) {
+		if r.Header.Get(sessionTokenHeader) != "" {
+			return nil, &AuthError{StatusCode: http.StatusForbidden, Err: errors.New("rejected")}
+		}
+		return nil, nil
+	})
+
+	tests := []struct {
+		name string
+		rv   *Rendezvous
+	}{
+		{
+			// The rendezvous URL is not handled, so the client fails to connect.
+			name: "not found",
+			rv:   &Rendezvous{URL: "/not-found"},
+		},
+		{
+			name: "rejected",
+			rv:   &Rendezvous{URL: "/rendezvous", Server: &Server{Authenticator: rejectRendezvous}},
+		},
+		{
+			// The client does not send its headers to other hosts.
+			name: "other host",
+			rv:   &Rendezvous{URL: "https://example.com/rendezvous"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			openErr := make(chan error, 1)
+			mux := http.NewServeMux()
+			mux.Handle("/rendezvous", tt.rv)
+			mux.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+				session, err := tt.rv.Accept(w, r)
+				require.NoError(t, err)
+				defer session.Close()
+
+				ctx, cancel := context.WithTimeout(r.Context(), 10*shortDuration)
+				defer cancel()
+				_, err = session.Open(ctx)
+				openErr <- err
+			})
+			server := h2test.NewServer(mux)
+			defer server.Close()
+
+			session, _, err := insecureClient.Session(context.Background(), server.URL+"/session")
+			require.NoError(t, err)
+			defer session.Close()
+
+			err = <-openErr
+			assert.IsType(t, &OpenError{}, err)
+
+			select {
+			case <-session.Done():
+			case <-time.After(10 * shortDuration):
+				t.Fatal("session was not closed by the server")
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package h2conn
+
+import (
+	"context"
+	"net/http"
+)
+
+// Shutdown gracefully shuts down the server connections.
+//
+// New connections are rejected with http.StatusServiceUnavailable, and Accept returns
+// http.ErrServerClosed. The GoingAway channel of existing connections is closed, and Shutdown
+// waits until their http handlers return. If the context expires first, the remaining
+// connections are closed with the CloseGoingAway code, and the context error is returned.
+//
+// Shutdown should be called before the Shutdown of the http.Server, which does not wait for
+// active connections.
+//
+// Usage:
+//
+//      ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+//      defer cancel()
+//      if err := server.Shutdown(ctx); err != nil {
+//          log.Printf("Forced close of connections: %s", err)
+//      }
+//      httpServer.Shutdown(ctx)
+//
+func (u *Server) Shutdown(ctx context.Context) error {
+	u.mu.Lock()
+	if !u.shuttingDown {
+		u.shuttingDown = true
+		u.drained = make(chan struct{})
+		for c := range u.conns {
+			close(c.goingAway)
+		}
+		if len(u.conns) == 0 {
+			close(u.drained)
+		}
+	}
+	drained := u.drained
+	u.mu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	for _, c := range u.Conns() {
+		c.CloseWithError(CloseGoingAway, "server shutting down")
+	}
+	return ctx.Err()
+}
+
+// Conns returns the connections that were accepted by the server and their http handler did
+// not return yet.
+func (u *Server) Conns() []*Conn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	conns := make([]*Conn, 0, len(u.conns))
+	for c := range u.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// register adds an accepted connection from the given remote host. It returns
+// http.ErrServerClosed if the server is shutting down, or a *LimitError if a connection limit
+// was reached.
+func (u *Server) register(c *Conn, remote string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	switch {
+	case u.shuttingDown:
+		return http.ErrServerClosed
+	case u.MaxConns > 0 && len(u.conns) >= u.MaxConns:
+		return &LimitError{Limit: "MaxConns", StatusCode: http.StatusServiceUnavailable}
+	case u.MaxConnsPerRemote > 0 && u.remotes[remote] >= u.MaxConnsPerRemote:
+		return &LimitError{Limit: "MaxConnsPerRemote", StatusCode: http.StatusTooManyRequests}
+	}
+	if u.conns == nil {
+		u.conns = make(map[*Conn]string)
+		u.remotes = make(map[string]int)
+	}
+	u.conns[c] = remote
+	u.remotes[remote]++
+	return nil
+}
+
+// unregister removes a connection after its http handler returned.
+func (u *Server) unregister(c *Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if remote, ok := u.conns[c]; ok {
+		delete(u.conns, c)
+		if u.remotes[remote]--; u.remotes[remote] == 0 {
+			delete(u.remotes, remote)
+		}
+	}
+	if u.shuttingDown && len(u.conns) == 0 && !isClosedChan(u.drained) {
+		close(u.drained)
+	}
+}
@@ -0,0 +1,134 @@
+package h2conn
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/posener/h2conn/h2test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestShutdown tests that shutdown notifies the handlers and waits for them to return.
+func TestShutdown(t *testing.T) {
+	t.Parallel()
+
+	u := &Server{}
+	server := h2test.NewServer(u.Handler(func(ctx context.Context, conn *Conn) error {
+		_, err := conn.Write([]byte("hello\n"))
+		if err != nil {
+			return err
+		}
+		<-conn.GoingAway()
+		_, err = conn.Write([]byte("bye\n"))
+		return err
+	}))
+	defer server.Close()
+
+	conn, _, err := insecureClient.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+	buf := bufio.NewReader(conn)
+	line, err := buf.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", line)
+	assert.Equal(t, 1, len(u.Conns()))
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- u.Shutdown(context.Background()) }()
+
+	got, err := io.ReadAll(buf)
+	assert.Equal(t, "bye\n", string(got))
+	assert.Equal(t, &CloseError{Code: CloseGoingAway, Reason: "server shutting down"}, err)
+	assert.NoError(t, <-shutdownErr)
+	assert.Equal(t, 0, len(u.Conns()))
+
+	// New connections are rejected.
+	conn2, resp, err := insecureClient.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	defer conn2.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+// TestShutdownForce tests that shutdown closes the connections that were not closed before the
+// context expired.
+func TestShutdownForce(t *testing.T) {
+	t.Parallel()
+
+	u := &Server{}
+	server := h2test.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := u.Accept(w, r)
+		require.NoError(t, err)
+		// Ignore the shutdown notification.
+		io.Copy(io.Discard, conn)
+		conn.Close()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	conn, _, err := insecureClient.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortDuration)
+	defer cancel()
+	start := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, u.Shutdown(ctx))
+	assert.True(t, time.Since(start) >= shortDuration)
+
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, &CloseError{Code: CloseGoingAway, Reason: "server shutting down"}, err)
+}
+
+// TestShutdownIdle tests shutdown of a server without connections.
+func TestShutdownIdle(t *testing.T) {
+	t.Parallel()
+
+	u := &Server{}
+	assert.NoError(t, u.Shutdown(context.Background()))
+	assert.NoError(t, u.Shutdown(context.Background()))
+}
+
+// TestShutdownForceBlockedWrite tests that shutdown aborts a write to a client that does not
+// read, such that the handler returns.
+func TestShutdownForceBlockedWrite(t *testing.T) {
+	t.Parallel()
+
+	u := &Server{}
+	handlerDone := make(chan error, 1)
+	server := h2test.NewServer(u.Handler(func(ctx context.Context, conn *Conn) error {
+		data := make([]byte, 64<<10)
+		for {
+			if _, err := conn.Write(data); err != nil {
+				handlerDone <- err
+				return err
+			}
+		}
+	}))
+	defer server.Close()
+
+	// The client never reads, such that the server writes are blocked by flow control.
+	conn, _, err := insecureClient.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortDuration)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, u.Shutdown(ctx))
+
+	select {
+	case err := <-handlerDone:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("handler write was not aborted")
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(u.Conns()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, len(u.Conns()))
+}
@@ -0,0 +1,130 @@
+package h2conn
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+)
+
+// Stream sends and receives typed values over a connection.
+// The values are encoded with a Codec, and the other side should use a Stream of the
+// same type and Codec.
+type Stream[T any] struct {
+	conn *Conn
+
+	enc      Encoder
+	encBuf   bytes.Buffer
+	sendLock sync.Mutex
+
+	dec         Decoder
+	recvLock    sync.Mutex
+	recvPending bool
+	recvDone    chan recvResult[T]
+}
+
+type recvResult[T any] struct {
+	v   T
+	err error
+}
+
+// NewStream returns a stream of values of type T over a connection.
+// The connection should not be used directly after this call.
+func NewStream[T any](conn *Conn, codec Codec) *Stream[T] {
+	s := &Stream[T]{
+		conn:     conn,
+		dec:      codec.NewDecoder(conn),
+		recvDone: make(chan recvResult[T], 1),
+	}
+	s.enc = codec.NewEncoder(&s.encBuf)
+	return s
+}
+
+// Send sends a value to the other side.
+// If the context is done before the value was sent, the context error is returned, and
+// the value may still be delivered to the other side. The write deadline of the connection
+// also applies, and is kept after the context is done.
+func (s *Stream[T]) Send(ctx context.Context, v T) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+
+	s.encBuf.Reset()
+	if err := s.enc.Encode(v); err != nil {
+		return err
+	}
+	return withContext(ctx, &s.conn.writeDeadline, func() error {
+		_, err := s.conn.Write(s.encBuf.Bytes())
+		return err
+	})
+}
+
+// Recv receives a value from the other side.
+// If the context is done before a value was received, the context error is returned, and
+// the value will be returned by the next call to Recv.
+func (s *Stream[T]) Recv(ctx context.Context) (T, error) {
+	s.recvLock.Lock()
+	defer s.recvLock.Unlock()
+
+	// Decoding is done in the background, such that a decoder will not be left in an
+	// inconsistent state when the context is done in the middle of a value.
+	if !s.recvPending {
+		s.recvPending = true
+		go func() {
+			var v T
+			err := s.dec.Decode(&v)
+			s.recvDone <- recvResult[T]{v: v, err: err}
+		}()
+	}
+
+	select {
+	case res := <-s.recvDone:
+		s.recvPending = false
+		return res.v, res.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// Close closes the underlying connection.
+func (s *Stream[T]) Close() error {
+	return s.conn.Close()
+}
+
+// aLongTimeAgo is a non-zero time, far in the past, used for immediate cancellation of I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// withContext runs an I/O operation, and interrupts it using the given deadline when the
+// context is done. The previous deadline is restored after an interrupted operation.
+func withContext(ctx context.Context, d *deadline, op func() error) error {
+	if ctx.Done() == nil {
+		return op()
+	}
+
+	var (
+		prev        time.Time
+		interrupted bool
+	)
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			prev, interrupted = d.get(), true
+			d.set(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+
+	err := op()
+	close(stop)
+	<-stopped
+	if interrupted {
+		d.set(prev)
+	}
+
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package h2conn
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type message struct {
+	ID   int
+	Text string
+}
+
+// TestStream tests sending and receiving typed values with the available codecs
+func TestStream(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name  string
+		codec Codec
+	}{
+		{name: "json", codec: JSON},
+		{name: "gob", codec: Gob},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			server, serverAccepted, serverHandlerWait := startServer()
+			defer server.Close()
+			defer close(serverHandlerWait)
+
+			clientConn, resp, err := insecureClient.Connect(context.Background(), server.URL)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			clientStream := NewStream[message](clientConn, tt.codec)
+			defer clientStream.Close()
+			serverStream := NewStream[message](<-serverAccepted, tt.codec)
+
+			ctx := context.Background()
+			for i := 0; i < 3; i++ {
+				require.NoError(t, clientStream.Send(ctx, message{ID: i, Text: "ping"}))
+				got, err := serverStream.Recv(ctx)
+				require.NoError(t, err)
+				assert.Equal(t, message{ID: i, Text: "ping"}, got)
+
+				require.NoError(t, serverStream.Send(ctx, message{ID: i, Text: "pong"}))
+				got, err = clientStream.Recv(ctx)
+				require.NoError(t, err)
+				assert.Equal(t, message{ID: i, Text: "pong"}, got)
+			}
+		})
+	}
+}
+
+// TestStreamCancel tests that a canceled receive does not lose values
+func TestStreamCancel(t *testing.T) {
+	t.Parallel()
+
+	server, serverAccepted, serverHandlerWait := startServer()
+	defer server.Close()
+	defer close(serverHandlerWait)
+
+	clientConn, resp, err := insecureClient.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	clientStream := NewStream[message](clientConn, JSON)
+	defer clientStream.Close()
+	serverStream := NewStream[message](<-serverAccepted, JSON)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortDuration)
+	defer cancel()
+	_, err = clientStream.Recv(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	require.NoError(t, serverStream.Send(context.Background(), message{ID: 1}))
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	got, err := clientStream.Recv(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, message{ID: 1}, got)
+}
+
+// TestStreamSendKeepsDeadline tests that Send does not change the write deadline of the
+// connection.
+func TestStreamSendKeepsDeadline(t *testing.T) {
+	t.Parallel()
+
+	server, serverAccepted, serverHandlerWait := startServer()
+	defer server.Close()
+	defer close(serverHandlerWait)
+
+	clientConn, _, err := insecureClient.Connect(context.Background(), server.URL)
+	require.NoError(t, err)
+	<-serverAccepted
+
+	stream := NewStream[message](clientConn, JSON)
+	defer stream.Close()
+	deadline := time.Now().Add(time.Hour)
+	require.NoError(t, clientConn.SetWriteDeadline(deadline))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, stream.Send(ctx, message{ID: 1}))
+	assert.True(t, deadline.Equal(clientConn.writeDeadline.get()))
+
+	// The server does not read, so a large value blocks until the context is done.
+	ctx, cancel = context.WithTimeout(context.Background(), shortDuration)
+	defer cancel()
+	err = stream.Send(ctx, message{Text: strings.Repeat("a", 10*1024*1024)})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, deadline.Equal(clientConn.writeDeadline.get()))
+}